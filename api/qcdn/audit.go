@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package qcdn
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/qiniu/go-sdk/v7/auth"
+)
+
+// AuditOp names a mutating operation for auditing purposes.
+type AuditOp string
+
+const (
+	AuditOpUploadCert        AuditOp = "UploadCert"
+	AuditOpDeleteCert        AuditOp = "DeleteCert"
+	AuditOpCreateDomain      AuditOp = "CreateDomain"
+	AuditOpOnlineDomain      AuditOp = "OnlineDomain"
+	AuditOpOfflineDomain     AuditOp = "OfflineDomain"
+	AuditOpDeleteDomain      AuditOp = "DeleteDomain"
+	AuditOpUpdateHTTPSConfig AuditOp = "UpdateHTTPSConfig"
+	AuditOpModifyDomainConf  AuditOp = "ModifyDomainConf"
+)
+
+// AuditEvent describes one finished mutating call.
+type AuditEvent struct {
+	Time time.Time
+	Op   AuditOp
+	// AK is the AccessKey the call is made with
+	AK string
+
+	// Domain is the domain operated on, if any
+	Domain string
+	// ConfKind is the kind of domain config modified, for
+	// AuditOpModifyDomainConf, e.g. "source"
+	ConfKind string
+	// CertID is the ID of the cert uploaded or deleted, or of the cert the
+	// domain is switched to
+	CertID string
+	// CertName is the name of the cert uploaded
+	CertName string
+	// OldHTTPS is the HTTPS config before AuditOpUpdateHTTPSConfig, if given to
+	// UpdateHTTPSConfigAudited
+	OldHTTPS *HTTPSConfig
+	// NewHTTPS is the HTTPS config requested by AuditOpUpdateHTTPSConfig
+	NewHTTPS *HTTPSConfig
+
+	// Err is the result of the call
+	Err error
+}
+
+// AuditHook receives AuditEvents. It may be called concurrently.
+type AuditHook func(e *AuditEvent)
+
+var auditHook atomic.Pointer[AuditHook]
+
+// SetAuditHook makes h receive an AuditEvent after every mutating call;
+// passing nil disables auditing.
+func SetAuditHook(h AuditHook) {
+	if h == nil {
+		auditHook.Store(nil)
+		return
+	}
+	auditHook.Store(&h)
+}
+
+func audit(mac *auth.Credentials, e *AuditEvent) {
+	h := auditHook.Load()
+	if h == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	e.AK = mac.AccessKey
+	(*h)(e)
+}
@@ -2,7 +2,11 @@
 
 package qcdn
 
-import "time"
+import (
+	"time"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qiniucommon"
+)
 
 // Keep the definitions here synced with the official docs:
 //
@@ -18,6 +22,281 @@ type HTTPSConfig struct {
 	ForceHTTPS bool `json:"forceHttps"`
 	// HTTP2Enabled http2功能是否启用，false为关闭，true为开启
 	HTTP2Enabled bool `json:"http2Enable"`
+
+	Extra Extra `json:"-"`
+}
+
+func (x *HTTPSConfig) UnmarshalJSON(data []byte) error {
+	type plain HTTPSConfig
+	return unmarshalKeepingExtra(data, (*plain)(x), &x.Extra)
+}
+
+func (x HTTPSConfig) MarshalJSON() ([]byte, error) {
+	type plain HTTPSConfig
+	return marshalWithExtra((*plain)(&x), x.Extra)
+}
+
+// SourceType 回源类型
+type SourceType string
+
+const (
+	// SourceTypeDomain 回源到域名
+	SourceTypeDomain SourceType = "domain"
+	// SourceTypeIP 回源到 IP
+	SourceTypeIP SourceType = "ip"
+	// SourceTypeQiniuBucket 回源到七牛存储空间
+	SourceTypeQiniuBucket SourceType = "qiniuBucket"
+	// SourceTypeAdvanced 高级回源
+	SourceTypeAdvanced SourceType = "advanced"
+)
+
+// SourceConfig 回源配置
+//
+// https://developer.qiniu.com/fusion/4249/product-features#1
+type SourceConfig struct {
+	// SourceType 回源类型
+	SourceType SourceType `json:"sourceType"`
+	// SourceHost 回源 Host
+	SourceHost string `json:"sourceHost,omitempty"`
+	// SourceIPs 回源 IP 列表，SourceType 为 ip 时有效
+	SourceIPs []string `json:"sourceIPs,omitempty"`
+	// SourceDomain 回源域名，SourceType 为 domain 时有效
+	SourceDomain string `json:"sourceDomain,omitempty"`
+	// SourceQiniuBucket 回源七牛存储空间名称，SourceType 为 qiniuBucket 时有效
+	SourceQiniuBucket string `json:"sourceQiniuBucket,omitempty"`
+	// SourceURLScheme 回源协议，可选 http、https，空值表示跟随请求协议
+	SourceURLScheme string `json:"sourceURLScheme,omitempty"`
+	// AdvancedSources 高级回源配置，SourceType 为 advanced 时有效
+	AdvancedSources []*AdvancedSource `json:"advancedSources,omitempty"`
+	// TestURLPath 域名的测试资源，需要保证这个资源是可访问的
+	TestURLPath string `json:"testURLPath,omitempty"`
+
+	Extra Extra `json:"-"`
+}
+
+func (x *SourceConfig) UnmarshalJSON(data []byte) error {
+	type plain SourceConfig
+	return unmarshalKeepingExtra(data, (*plain)(x), &x.Extra)
+}
+
+func (x SourceConfig) MarshalJSON() ([]byte, error) {
+	type plain SourceConfig
+	return marshalWithExtra((*plain)(&x), x.Extra)
+}
+
+// AdvancedSource 高级回源的一个源站
+type AdvancedSource struct {
+	// Addr 源站地址，可以是 IP 或域名
+	Addr string `json:"addr"`
+	// Weight 权重
+	Weight int `json:"weight"`
+	// Backup 是否为备用源站
+	Backup bool `json:"backup"`
+
+	Extra Extra `json:"-"`
+}
+
+func (x *AdvancedSource) UnmarshalJSON(data []byte) error {
+	type plain AdvancedSource
+	return unmarshalKeepingExtra(data, (*plain)(x), &x.Extra)
+}
+
+func (x AdvancedSource) MarshalJSON() ([]byte, error) {
+	type plain AdvancedSource
+	return marshalWithExtra((*plain)(&x), x.Extra)
+}
+
+// CacheControlType 缓存规则类型
+type CacheControlType string
+
+const (
+	// CacheControlTypeAll 全局默认规则
+	CacheControlTypeAll CacheControlType = "all"
+	// CacheControlTypePath 按路径前缀匹配
+	CacheControlTypePath CacheControlType = "path"
+	// CacheControlTypeSuffix 按文件后缀匹配
+	CacheControlTypeSuffix CacheControlType = "suffix"
+	// CacheControlTypeFollow 遵循源站
+	CacheControlTypeFollow CacheControlType = "follow"
+)
+
+// CacheTimeUnit 缓存时间单位
+type CacheTimeUnit int
+
+const (
+	CacheTimeUnitSecond CacheTimeUnit = 0
+	CacheTimeUnitMinute CacheTimeUnit = 1
+	CacheTimeUnitHour   CacheTimeUnit = 2
+	CacheTimeUnitDay    CacheTimeUnit = 3
+	CacheTimeUnitWeek   CacheTimeUnit = 4
+	CacheTimeUnitMonth  CacheTimeUnit = 5
+	CacheTimeUnitYear   CacheTimeUnit = 6
+)
+
+// CacheConfig 缓存策略
+//
+// https://developer.qiniu.com/fusion/4249/product-features#2
+type CacheConfig struct {
+	// CacheControls 缓存规则列表，按顺序匹配
+	CacheControls []*CacheControl `json:"cacheControls"`
+	// IgnoreParam 是否忽略 URL 参数进行缓存
+	IgnoreParam bool `json:"ignoreParam"`
+
+	Extra Extra `json:"-"`
+}
+
+func (x *CacheConfig) UnmarshalJSON(data []byte) error {
+	type plain CacheConfig
+	return unmarshalKeepingExtra(data, (*plain)(x), &x.Extra)
+}
+
+func (x CacheConfig) MarshalJSON() ([]byte, error) {
+	type plain CacheConfig
+	return marshalWithExtra((*plain)(&x), x.Extra)
+}
+
+// CacheControl 一条缓存规则
+type CacheControl struct {
+	// Time 缓存时间，与 TimeUnit 配合使用
+	Time int `json:"time"`
+	// TimeUnit 缓存时间单位
+	TimeUnit CacheTimeUnit `json:"timeunit"`
+	// Type 规则类型
+	Type CacheControlType `json:"type"`
+	// Rule 规则内容，多个值以分号 ; 分隔
+	Rule string `json:"rule"`
+
+	Extra Extra `json:"-"`
+}
+
+func (x *CacheControl) UnmarshalJSON(data []byte) error {
+	type plain CacheControl
+	return unmarshalKeepingExtra(data, (*plain)(x), &x.Extra)
+}
+
+func (x CacheControl) MarshalJSON() ([]byte, error) {
+	type plain CacheControl
+	return marshalWithExtra((*plain)(&x), x.Extra)
+}
+
+// ACLType 黑白名单类型
+type ACLType string
+
+const (
+	// ACLTypeNone 不启用黑白名单
+	ACLTypeNone ACLType = ""
+	// ACLTypeBlack 黑名单
+	ACLTypeBlack ACLType = "black"
+	// ACLTypeWhite 白名单
+	ACLTypeWhite ACLType = "white"
+)
+
+// RefererConfig referer防盗链
+//
+// https://developer.qiniu.com/fusion/4249/product-features#3
+type RefererConfig struct {
+	// RefererType referer 黑白名单类型
+	RefererType ACLType `json:"refererType"`
+	// RefererValues referer 列表，支持通配符 *
+	RefererValues []string `json:"refererValues"`
+	// NullReferer 是否允许空 referer
+	NullReferer bool `json:"nullReferer"`
+
+	Extra Extra `json:"-"`
+}
+
+func (x *RefererConfig) UnmarshalJSON(data []byte) error {
+	type plain RefererConfig
+	return unmarshalKeepingExtra(data, (*plain)(x), &x.Extra)
+}
+
+func (x RefererConfig) MarshalJSON() ([]byte, error) {
+	type plain RefererConfig
+	return marshalWithExtra((*plain)(&x), x.Extra)
+}
+
+// IPACLConfig ip黑白名单
+//
+// https://developer.qiniu.com/fusion/4249/product-features#4
+type IPACLConfig struct {
+	// IPACLType ip 黑白名单类型
+	IPACLType ACLType `json:"ipACLType"`
+	// IPACLValues ip 或网段列表
+	IPACLValues []string `json:"ipACLValues"`
+
+	Extra Extra `json:"-"`
+}
+
+func (x *IPACLConfig) UnmarshalJSON(data []byte) error {
+	type plain IPACLConfig
+	return unmarshalKeepingExtra(data, (*plain)(x), &x.Extra)
+}
+
+func (x IPACLConfig) MarshalJSON() ([]byte, error) {
+	type plain IPACLConfig
+	return marshalWithExtra((*plain)(&x), x.Extra)
+}
+
+// TimeACLConfig 时间戳防盗链
+//
+// https://developer.qiniu.com/fusion/4249/product-features#5
+type TimeACLConfig struct {
+	// Enable 是否开启时间戳防盗链
+	Enable bool `json:"enable"`
+	// TimeACLKeys 密钥列表，最多两个
+	TimeACLKeys []string `json:"timeACLKeys"`
+	// CheckURL 用于验证配置正确性的带签名 URL
+	CheckURL string `json:"checkUrl"`
+
+	Extra Extra `json:"-"`
+}
+
+func (x *TimeACLConfig) UnmarshalJSON(data []byte) error {
+	type plain TimeACLConfig
+	return unmarshalKeepingExtra(data, (*plain)(x), &x.Extra)
+}
+
+func (x TimeACLConfig) MarshalJSON() ([]byte, error) {
+	type plain TimeACLConfig
+	return marshalWithExtra((*plain)(&x), x.Extra)
+}
+
+// BsauthConfig 回源鉴权
+//
+// https://developer.qiniu.com/fusion/4249/product-features#6
+type BsauthConfig struct {
+	// Enable 是否开启回源鉴权
+	Enable bool `json:"enable"`
+	// Path 需要鉴权的路径前缀列表
+	Path []string `json:"path"`
+	// Method 鉴权请求的 HTTP 方法
+	Method string `json:"method"`
+	// Parameters 透传给鉴权服务器的参数列表
+	Parameters []string `json:"parameters"`
+	// TimeLimit 鉴权结果的缓存时长，单位毫秒
+	TimeLimit int `json:"timeLimit"`
+	// UserAuthURL 鉴权服务器地址
+	UserAuthURL string `json:"userAuthUrl"`
+	// Strict 鉴权服务器不可用时是否拒绝请求
+	Strict bool `json:"strict"`
+	// SuccessStatusCode 鉴权成功时鉴权服务器返回的状态码
+	SuccessStatusCode int `json:"successStatusCode"`
+	// FailureStatusCode 鉴权失败时返回给客户端的状态码
+	FailureStatusCode int `json:"failureStatusCode"`
+	// IsQiniuPrivate 源站是否为七牛私有存储空间
+	IsQiniuPrivate bool `json:"isQiniuPrivate"`
+
+	Extra Extra `json:"-"`
+}
+
+func (x *BsauthConfig) UnmarshalJSON(data []byte) error {
+	type plain BsauthConfig
+	return unmarshalKeepingExtra(data, (*plain)(x), &x.Extra)
+}
+
+func (x BsauthConfig) MarshalJSON() ([]byte, error) {
+	type plain BsauthConfig
+	return marshalWithExtra((*plain)(&x), x.Extra)
 }
 
 type DomainType string
@@ -86,18 +365,18 @@ type Domain struct {
 	IPTypes     IPType `json:"ipTypes"`
 	// TagList 域名的标签列表
 	TagList []string `json:"tagList"`
-	// Source 结构请参考 回源配置
-	Source any `json:"source"`
-	// Cache 结构请参考 缓存策略
-	Cache any `json:"cache"`
-	// Referer 结构请参考 referer防盗链
-	Referer any `json:"referer"`
-	// IPACL 结构请参考 ip黑白名单
-	IPACL any `json:"ipACL"`
-	// TimeACL 结构请参考 时间戳防盗链
-	TimeACL any `json:"timeACL"`
-	// Bsauth 结构请参考 回源鉴权
-	Bsauth any `json:"bsauth"`
+	// Source 回源配置
+	Source *SourceConfig `json:"source"`
+	// Cache 缓存策略
+	Cache *CacheConfig `json:"cache"`
+	// Referer referer防盗链
+	Referer *RefererConfig `json:"referer"`
+	// IPACL ip黑白名单
+	IPACL *IPACLConfig `json:"ipACL"`
+	// TimeACL 时间戳防盗链
+	TimeACL *TimeACLConfig `json:"timeACL"`
+	// Bsauth 回源鉴权
+	Bsauth *BsauthConfig `json:"bsauth"`
 	// LastOp 域名最近一次操作类型
 	LastOp OpKind `json:"operationType"`
 	// LastOpStatus 域名最近一次的操作状态
@@ -113,6 +392,46 @@ type Domain struct {
 	HTTPS *HTTPSConfig `json:"https"`
 }
 
+// IsFrozen 域名是否已被冻结
+func (d *Domain) IsFrozen() bool {
+	return d.LastOpStatus == OpStatusFrozen
+}
+
+// IsOffline 域名是否已下线
+func (d *Domain) IsOffline() bool {
+	return d.LastOpStatus == OpStatusOfflined
+}
+
+// ReqCreateDomain 创建域名
+//
+// https://developer.qiniu.com/fusion/4246/the-domain-name#3
+type ReqCreateDomain struct {
+	// Type 域名类型，不填默认为 normal
+	Type DomainType `json:"type,omitempty"`
+	// Platform 平台类型，可选 web、download、vod
+	Platform string `json:"platform"`
+	// GeoCover 覆盖范围，可选 china、foreign、global
+	GeoCover string `json:"geoCover"`
+	// Protocol 协议，可选 http、https
+	Protocol string `json:"protocol"`
+	// IPTypes 支持的 IP 协议版本，不填默认为仅 IPv4
+	IPTypes IPType `json:"ipTypes,omitempty"`
+	// ParentDomain 父域名，创建泛子域名时必填
+	ParentDomain string `json:"pareDomain,omitempty"`
+	// Source 回源配置
+	Source *SourceConfig `json:"source,omitempty"`
+	// Cache 缓存策略
+	Cache *CacheConfig `json:"cache,omitempty"`
+	// Referer referer防盗链
+	Referer *RefererConfig `json:"referer,omitempty"`
+	// IPACL ip黑白名单
+	IPACL *IPACLConfig `json:"ipACL,omitempty"`
+	// TimeACL 时间戳防盗链
+	TimeACL *TimeACLConfig `json:"timeACL,omitempty"`
+	// HTTPS HTTPS 配置，Protocol 为 https 时必填
+	HTTPS *HTTPSConfig `json:"https,omitempty"`
+}
+
 type ReqListDomains struct {
 	// Types 域名类型，可选normal（普通域名）、wildcard（泛域名）、pan（泛子域名）、test（测试域名）中的一个或多个，不填默认查询全部域名。
 	Types []DomainType
@@ -143,3 +462,18 @@ type RespListDomains struct {
 	Marker  string    `json:"marker"`
 	Domains []*Domain `json:"domains"`
 }
+
+const (
+	// ErrInvalidParams 请求参数错误
+	ErrInvalidParams qiniucommon.ErrorCode = 400000
+	// ErrInvalidDomain 无效的域名
+	ErrInvalidDomain qiniucommon.ErrorCode = 400001
+	// ErrInvalidDomainType 无效的域名类型
+	ErrInvalidDomainType qiniucommon.ErrorCode = 400002
+	// ErrDomainAlreadyExists 域名已存在
+	ErrDomainAlreadyExists qiniucommon.ErrorCode = 400004
+	// ErrDomainOperationInProgress 域名正在操作中，需等待上一次操作完成
+	ErrDomainOperationInProgress qiniucommon.ErrorCode = 400080
+	// ErrNoSuchDomain 域名不存在
+	ErrNoSuchDomain qiniucommon.ErrorCode = 404001
+)
@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package qcdn
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Extra holds the members of a JSON object that are not modeled by the
+// containing Go struct, so that read-modify-write cycles against the API
+// don't silently drop fields we don't know about (yet).
+type Extra map[string]json.RawMessage
+
+// unmarshalKeepingExtra decodes data into v, which must be a pointer to a
+// struct type without custom unmarshalers, and stashes every object member not
+// claimed by one of v's fields into extra.
+func unmarshalKeepingExtra(data []byte, v any, extra *Extra) error {
+	*extra = nil
+
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return err
+	}
+
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return err
+	}
+
+	known := jsonFieldNames(reflect.TypeOf(v).Elem())
+	for k, raw := range all {
+		if isKnownJSONField(known, k) {
+			continue
+		}
+		if *extra == nil {
+			*extra = make(Extra)
+		}
+		(*extra)[k] = raw
+	}
+
+	return nil
+}
+
+// marshalWithExtra encodes v and merges the members of extra into the
+// resulting object. Members already produced by v take precedence.
+func marshalWithExtra(v any, extra Extra) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(extra) == 0 {
+		return data, nil
+	}
+
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, raw := range extra {
+		if _, ok := all[k]; !ok {
+			all[k] = raw
+		}
+	}
+
+	return json.Marshal(all)
+}
+
+func jsonFieldNames(t reflect.Type) []string {
+	var result []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		result = append(result, name)
+	}
+	return result
+}
+
+func isKnownJSONField(known []string, key string) bool {
+	// encoding/json matches object keys to field names case-insensitively
+	for _, k := range known {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
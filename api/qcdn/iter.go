@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package qcdn
+
+import "iter"
+
+// pageFetcher fetches the page starting at marker, returning the items and
+// the marker of the next page.
+type pageFetcher[T any] func(marker string) ([]T, string, error)
+
+// paginate turns a marker-based listing API into an iterator. Pages are only
+// fetched on demand, so stopping the iteration early saves the remaining
+// requests.
+//
+// The listing ends when a page comes back empty or without a next marker.
+// Errors are yielded once, after which the iteration stops.
+func paginate[T any](fetch pageFetcher[T]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		marker := ""
+		for {
+			items, nextMarker, err := fetch(marker)
+			if err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+
+			for _, x := range items {
+				if !yield(x, nil) {
+					return
+				}
+			}
+
+			if len(items) == 0 || nextMarker == "" {
+				return
+			}
+			marker = nextMarker
+		}
+	}
+}
+
+// Collect drains the iterator into a slice, stopping at the first error.
+func Collect[T any](seq iter.Seq2[T, error]) ([]T, error) {
+	var result []T
+	for x, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, x)
+	}
+	return result, nil
+}
@@ -3,6 +3,7 @@
 package qcdn
 
 import (
+	"iter"
 	"log/slog"
 	"net/http"
 	"net/url"
@@ -27,32 +28,87 @@ func GetDomain(mac *auth.Credentials, domain string) (*Domain, error) {
 	return qiniucommon.RequestWithBody[*Domain](mac, sb.String(), nil)
 }
 
+func CreateDomain(mac *auth.Credentials, domain string, req *ReqCreateDomain) error {
+	var sb strings.Builder
+	sb.WriteString(defaultHost)
+	sb.WriteString("/domain/")
+	sb.WriteString(url.PathEscape(domain))
+
+	_, err := qiniucommon.RequestWithBody[struct{}](mac, sb.String(), req)
+	e := AuditEvent{Op: AuditOpCreateDomain, Domain: domain, Err: err}
+	if req.HTTPS != nil {
+		e.CertID = req.HTTPS.CertID
+		e.NewHTTPS = req.HTTPS
+	}
+	audit(mac, &e)
+	return err
+}
+
+func OnlineDomain(mac *auth.Credentials, domain string) error {
+	err := changeDomainState(mac, domain, "online")
+	audit(mac, &AuditEvent{Op: AuditOpOnlineDomain, Domain: domain, Err: err})
+	return err
+}
+
+func OfflineDomain(mac *auth.Credentials, domain string) error {
+	err := changeDomainState(mac, domain, "offline")
+	audit(mac, &AuditEvent{Op: AuditOpOfflineDomain, Domain: domain, Err: err})
+	return err
+}
+
+func changeDomainState(mac *auth.Credentials, domain string, action string) error {
+	var sb strings.Builder
+	sb.WriteString(defaultHost)
+	sb.WriteString("/domain/")
+	sb.WriteString(url.PathEscape(domain))
+	sb.WriteRune('/')
+	sb.WriteString(action)
+
+	_, err := qiniucommon.RequestWithBody[struct{}](mac, sb.String(), nil, http.MethodPost)
+	return err
+}
+
+// DeleteDomain deletes the domain, which must have been taken offline first.
+func DeleteDomain(mac *auth.Credentials, domain string) error {
+	var sb strings.Builder
+	sb.WriteString(defaultHost)
+	sb.WriteString("/domain/")
+	sb.WriteString(url.PathEscape(domain))
+
+	_, err := qiniucommon.RequestWithBody[struct{}](mac, sb.String(), nil, http.MethodDelete)
+	audit(mac, &AuditEvent{Op: AuditOpDeleteDomain, Domain: domain, Err: err})
+	return err
+}
+
+func ListAllDomains(mac *auth.Credentials) ([]*Domain, error) {
+	return Collect(AllDomains(mac, ReqListDomains{}))
+}
+
 func ListAllDomainsByCertID(mac *auth.Credentials, certID string) ([]*Domain, error) {
-	var result []*Domain
+	return Collect(AllDomains(mac, ReqListDomains{CertID: certID}))
+}
 
-	marker := ""
-	for {
-		req := ReqListDomains{
-			CertID: certID,
-			Marker: marker,
-		}
-		resp, err := listDomains(mac, &req)
-		if err != nil {
-			return nil, err
-		}
+// AllDomains iterates over all domains matching the filters in req. The
+// Marker of req is ignored, and Limit is used as the page size.
+func AllDomains(mac *auth.Credentials, req ReqListDomains) iter.Seq2[*Domain, error] {
+	return paginate(func(marker string) ([]*Domain, string, error) {
+		pageReq := req
+		pageReq.Marker = marker
 
-		if len(resp.Domains) == 0 {
-			break
+		slog.Debug("listing domains", "marker", marker)
+		resp, err := ListDomains(mac, &pageReq)
+		if err != nil {
+			return nil, "", err
 		}
 
-		marker = resp.Marker
-		result = append(result, resp.Domains...)
-	}
-
-	return result, nil
+		slog.Debug("got domain list", "newMarker", resp.Marker, "numDomains", len(resp.Domains))
+		return resp.Domains, resp.Marker, nil
+	})
 }
 
-func listDomains(mac *auth.Credentials, req *ReqListDomains) (*RespListDomains, error) {
+// ListDomains fetches one page of domains matching the filters in req.
+// Out-of-range values of req.Limit are normalized to the API default.
+func ListDomains(mac *auth.Credentials, req *ReqListDomains) (*RespListDomains, error) {
 	var sb strings.Builder
 	sb.WriteString(defaultHost)
 	sb.WriteString("/domain")
@@ -92,7 +148,20 @@ func listDomains(mac *auth.Credentials, req *ReqListDomains) (*RespListDomains,
 	return qiniucommon.RequestWithBody[*RespListDomains](mac, sb.String(), nil)
 }
 
+// UpdateHTTPSConfig replaces the HTTPS config of the domain.
 func UpdateHTTPSConfig(mac *auth.Credentials, domain string, newConf *HTTPSConfig) error {
+	return UpdateHTTPSConfigAudited(mac, domain, nil, newConf)
+}
+
+// UpdateHTTPSConfigAudited is UpdateHTTPSConfig, but with oldConf, the config
+// being replaced as already known to the caller, included in the AuditEvent.
+// oldConf may be nil if unknown.
+func UpdateHTTPSConfigAudited(
+	mac *auth.Credentials,
+	domain string,
+	oldConf *HTTPSConfig,
+	newConf *HTTPSConfig,
+) error {
 	var sb strings.Builder
 	sb.WriteString(defaultHost)
 	sb.WriteString("/domain/")
@@ -100,6 +169,51 @@ func UpdateHTTPSConfig(mac *auth.Credentials, domain string, newConf *HTTPSConfi
 	sb.WriteString("/httpsconf")
 
 	_, err := qiniucommon.RequestWithBody[struct{}](mac, sb.String(), newConf, http.MethodPut)
+	audit(mac, &AuditEvent{
+		Op:       AuditOpUpdateHTTPSConfig,
+		Domain:   domain,
+		CertID:   newConf.CertID,
+		OldHTTPS: oldConf,
+		NewHTTPS: newConf,
+		Err:      err,
+	})
+	return err
+}
+
+func ModifySource(mac *auth.Credentials, domain string, newConf *SourceConfig) error {
+	return modifyDomainConf(mac, domain, "source", newConf)
+}
+
+func ModifyCache(mac *auth.Credentials, domain string, newConf *CacheConfig) error {
+	return modifyDomainConf(mac, domain, "cache", newConf)
+}
+
+func ModifyReferer(mac *auth.Credentials, domain string, newConf *RefererConfig) error {
+	return modifyDomainConf(mac, domain, "referer", newConf)
+}
+
+func ModifyIPACL(mac *auth.Credentials, domain string, newConf *IPACLConfig) error {
+	return modifyDomainConf(mac, domain, "ipacl", newConf)
+}
+
+func ModifyTimeACL(mac *auth.Credentials, domain string, newConf *TimeACLConfig) error {
+	return modifyDomainConf(mac, domain, "timeacl", newConf)
+}
+
+func ModifyBsauth(mac *auth.Credentials, domain string, newConf *BsauthConfig) error {
+	return modifyDomainConf(mac, domain, "bsauth", newConf)
+}
+
+func modifyDomainConf(mac *auth.Credentials, domain string, confKind string, newConf any) error {
+	var sb strings.Builder
+	sb.WriteString(defaultHost)
+	sb.WriteString("/domain/")
+	sb.WriteString(url.PathEscape(domain))
+	sb.WriteRune('/')
+	sb.WriteString(confKind)
+
+	_, err := qiniucommon.RequestWithBody[struct{}](mac, sb.String(), newConf, http.MethodPut)
+	audit(mac, &AuditEvent{Op: AuditOpModifyDomainConf, Domain: domain, ConfKind: confKind, Err: err})
 	return err
 }
 
@@ -108,26 +222,26 @@ func UpdateHTTPSConfig(mac *auth.Credentials, domain string, newConf *HTTPSConfi
 const defaultListCertsPageSize = 100
 
 func ListAllCerts(mac *auth.Credentials) ([]*Cert, error) {
-	var result []*Cert
+	return Collect(AllCerts(mac, defaultListCertsPageSize))
+}
 
-	marker := ""
-	for {
+// AllCerts iterates over all certs of the account, fetching pageSize certs at
+// a time. A non-positive pageSize means the default page size.
+func AllCerts(mac *auth.Credentials, pageSize int) iter.Seq2[*Cert, error] {
+	if pageSize <= 0 {
+		pageSize = defaultListCertsPageSize
+	}
+
+	return paginate(func(marker string) ([]*Cert, string, error) {
 		slog.Debug("listing certs", "marker", marker)
-		resp, err := listCerts(mac, marker, defaultListCertsPageSize)
+		resp, err := listCerts(mac, marker, pageSize)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
 		slog.Debug("got cert list", "newMarker", resp.Marker, "numCerts", len(resp.Certs))
-		marker = resp.Marker
-		result = append(result, resp.Certs...)
-
-		if len(resp.Certs) == 0 {
-			break
-		}
-	}
-
-	return result, nil
+		return resp.Certs, resp.Marker, nil
+	})
 }
 
 func listCerts(mac *auth.Credentials, marker string, limit int) (*RespListCerts, error) {
@@ -151,8 +265,28 @@ func listCerts(mac *auth.Credentials, marker string, limit int) (*RespListCerts,
 	return qiniucommon.RequestWithBody[*RespListCerts](mac, sb.String(), nil)
 }
 
+// GetCert fetches the details of the cert, including its chain and private
+// key.
+func GetCert(mac *auth.Credentials, id string) (*Cert, error) {
+	var sb strings.Builder
+	sb.WriteString(defaultHost)
+	sb.WriteString("/sslcert/")
+	sb.WriteString(url.PathEscape(id))
+
+	resp, err := qiniucommon.RequestWithBody[*RespGetCert](mac, sb.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Cert, nil
+}
+
 func UploadCert(mac *auth.Credentials, req *ReqUploadCert) (id string, err error) {
 	resp, err := qiniucommon.RequestWithBody[RespUploadCert](mac, defaultHost+"/sslcert", req)
+	e := AuditEvent{Op: AuditOpUploadCert, CertName: req.Name, Err: err}
+	if err == nil {
+		e.CertID = resp.ID
+	}
+	audit(mac, &e)
 	if err != nil {
 		return "", err
 	}
@@ -167,5 +301,6 @@ func DeleteCert(mac *auth.Credentials, id string) error {
 	sb.WriteString(id)
 
 	_, err := qiniucommon.RequestWithBody[struct{}](mac, sb.String(), nil, http.MethodDelete)
+	audit(mac, &AuditEvent{Op: AuditOpDeleteCert, CertID: id, Err: err})
 	return err
 }
@@ -2,6 +2,8 @@
 
 package qcdn
 
+import "github.com/xen0n/qiniu-cert-refresher/api/qiniucommon"
+
 // Keep the definitions here synced with the official docs:
 //
 // https://developer.qiniu.com/fusion/8593/interface-related-certificate
@@ -43,6 +45,10 @@ type RespUploadCert struct {
 	ID string `json:"certid"`
 }
 
+type RespGetCert struct {
+	Cert *Cert `json:"cert"`
+}
+
 type RespListCerts struct {
 	// Marker 用于标示下一次从哪个位置开始获取证书列表
 	Marker string  `json:"marker"`
@@ -51,21 +57,21 @@ type RespListCerts struct {
 
 const (
 	// ErrValidityPeriodTooShort https证书有效期太短
-	ErrValidityPeriodTooShort = 400322
+	ErrValidityPeriodTooShort qiniucommon.ErrorCode = 400322
 	// ErrFailedToVerifyCertChain 验证https证书链失败
-	ErrFailedToVerifyCertChain = 400323
+	ErrFailedToVerifyCertChain qiniucommon.ErrorCode = 400323
 	// ErrCertAlreadyExpired https证书过期
-	ErrCertAlreadyExpired = 400329
+	ErrCertAlreadyExpired qiniucommon.ErrorCode = 400329
 	// ErrNoSuchCert 无此证书
-	ErrNoSuchCert = 400401
+	ErrNoSuchCert qiniucommon.ErrorCode = 400401
 	// ErrCertQuotaExceeded 超过用户绑定证书最大额度
-	ErrCertQuotaExceeded = 400500
+	ErrCertQuotaExceeded qiniucommon.ErrorCode = 400500
 	// ErrStillBoundToCDNDomain 证书已绑定CDN域名
-	ErrStillBoundToCDNDomain = 400611
+	ErrStillBoundToCDNDomain qiniucommon.ErrorCode = 400611
 	// ErrStillBoundToStorageDomain 证书已绑定存储域名
-	ErrStillBoundToStorageDomain = 400911
+	ErrStillBoundToStorageDomain qiniucommon.ErrorCode = 400911
 	// ErrFailedToParseCert https证书解码失败
-	ErrFailedToParseCert = 404906
+	ErrFailedToParseCert qiniucommon.ErrorCode = 404906
 	// ErrUnauthorizedForThisCert 无权操作该证书
-	ErrUnauthorizedForThisCert = 404908
+	ErrUnauthorizedForThisCert qiniucommon.ErrorCode = 404908
 )
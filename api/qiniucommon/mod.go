@@ -5,10 +5,14 @@ package qiniucommon
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/qiniu/go-sdk/v7/auth"
 )
@@ -16,12 +20,138 @@ import (
 type RespError struct {
 	Code     int    `json:"code"`
 	ErrorMsg string `json:"error"`
+
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int `json:"-"`
+	// ReqID is the Qiniu request ID (the X-Reqid header) of the response,
+	// useful when reporting problems to Qiniu.
+	ReqID string `json:"-"`
+	// Method is the HTTP method of the failed request.
+	Method string `json:"-"`
+	// Path is the URL path of the failed request.
+	Path string `json:"-"`
 }
 
 var _ error = (*RespError)(nil)
 
 func (e *RespError) Error() string {
-	return fmt.Sprintf("Qiniu error %d: %s", e.Code, e.ErrorMsg)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Qiniu error %d: %s", e.Code, e.ErrorMsg)
+	if e.StatusCode != 0 {
+		fmt.Fprintf(&sb, " (HTTP %d, %s %s", e.StatusCode, e.Method, e.Path)
+		if len(e.ReqID) > 0 {
+			fmt.Fprintf(&sb, ", reqid %s", e.ReqID)
+		}
+		sb.WriteRune(')')
+	}
+	return sb.String()
+}
+
+// Is makes RespError match ErrorCode values with the same code, as well as
+// the error class sentinels ErrRetryable, ErrAuth, ErrNotFound and
+// ErrPermanent.
+func (e *RespError) Is(target error) bool {
+	if code, ok := target.(ErrorCode); ok {
+		return e.Code == int(code)
+	}
+
+	switch target {
+	case ErrRetryable:
+		return e.isRetryable()
+	case ErrAuth:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrPermanent:
+		return !e.isRetryable()
+	}
+
+	return false
+}
+
+func (e *RespError) isRetryable() bool {
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests:
+		return true
+	case e.StatusCode == statusQiniuRateLimited:
+		return true
+	case e.StatusCode >= 500 && e.StatusCode != http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// statusQiniuRateLimited is the non-standard HTTP status Qiniu uses for
+// requests exceeding the rate limit.
+const statusQiniuRateLimited = 573
+
+// ErrorCode is a Qiniu API error code. RespError values with the same code
+// match it with errors.Is, so the code constants can be used as sentinels.
+type ErrorCode int
+
+var _ error = ErrorCode(0)
+
+func (c ErrorCode) Error() string {
+	return fmt.Sprintf("Qiniu error %d", int(c))
+}
+
+// Classes of API errors, for use with errors.Is.
+var (
+	// ErrRetryable means the request may succeed if retried later, e.g. on
+	// rate limiting or server-side failures.
+	ErrRetryable = errors.New("retryable Qiniu API error")
+	// ErrAuth means the credentials are invalid or lack the permission.
+	ErrAuth = errors.New("authentication failure with the Qiniu API")
+	// ErrNotFound means the requested resource does not exist.
+	ErrNotFound = errors.New("resource not found via the Qiniu API")
+	// ErrPermanent means retrying the same request is pointless.
+	ErrPermanent = errors.New("permanent Qiniu API error")
+)
+
+// IsRetryable reports whether the request that returned err may succeed if
+// retried, which is the case for transport-level failures as well.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var respErr *RespError
+	if errors.As(err, &respErr) {
+		return respErr.isRetryable()
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// maxErrorBodyInMsg limits how much of a non-JSON error body is kept.
+const maxErrorBodyInMsg = 256
+
+func newRespError(req *http.Request, resp *http.Response, body []byte) *RespError {
+	var e RespError
+	err := json.Unmarshal(body, &e)
+	if err != nil || (e.Code == 0 && len(e.ErrorMsg) == 0) {
+		// not a Qiniu error object, e.g. from a gateway in between
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > maxErrorBodyInMsg {
+			// cut on a rune boundary to keep the message valid UTF-8
+			n := maxErrorBodyInMsg
+			for n > 0 && !utf8.RuneStart(msg[n]) {
+				n--
+			}
+			msg = msg[:n] + "..."
+		}
+		if len(msg) == 0 {
+			msg = http.StatusText(resp.StatusCode)
+		}
+		e = RespError{ErrorMsg: msg}
+	}
+
+	e.StatusCode = resp.StatusCode
+	e.ReqID = resp.Header.Get("X-Reqid")
+	e.Method = req.Method
+	e.Path = req.URL.Path
+	return &e
 }
 
 // RequestWithBody 带body对api发出请求并且返回response body
@@ -47,9 +177,11 @@ func RequestWithBody[Resp any](
 		}
 	}
 
+	var reqData []byte
 	var bodyReader io.Reader
 	if body != nil {
-		reqData, err := json.Marshal(body)
+		var err error
+		reqData, err = json.Marshal(body)
 		if err != nil {
 			return zeroResp, err
 		}
@@ -72,28 +204,23 @@ func RequestWithBody[Resp any](
 		req.Header.Add("Content-Type", "application/json")
 	}
 
-	slog.Debug("about to make HTTP call", "req", req)
+	start := time.Now()
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
+		traceHTTP(req, reqData, nil, nil, time.Since(start), err)
 		return zeroResp, err
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
+	traceHTTP(req, reqData, resp, respBody, time.Since(start), err)
 	if err != nil {
 		return zeroResp, err
 	}
 
-	slog.Debug("got HTTP response", "req", req, "statusCode", resp.StatusCode, "body", respBody)
-
 	if resp.StatusCode >= 400 {
 		// this is an error
-		var errObj RespError
-		err = json.Unmarshal(respBody, &errObj)
-		if err != nil {
-			return zeroResp, err
-		}
-		return zeroResp, &errObj
+		return zeroResp, newRespError(req, resp, respBody)
 	}
 
 	var result Resp
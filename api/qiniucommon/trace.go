@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package qiniucommon
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+var traceBodies atomic.Bool
+
+// SetTraceBodies controls whether HTTP traces include the request and
+// response bodies. Secrets are masked from the bodies regardless.
+func SetTraceBodies(enabled bool) {
+	traceBodies.Store(enabled)
+}
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// RegisterSecret makes every verbatim occurrence of s in HTTP traces masked,
+// for secrets that don't live in well-known JSON fields, such as SKs.
+func RegisterSecret(s string) {
+	if len(s) == 0 {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, s)
+}
+
+func maskRegisteredSecrets(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+// sensitiveJSONKeys are the (lowercased) object keys whose values are always
+// masked in traced bodies.
+var sensitiveJSONKeys = map[string]struct{}{
+	"pri":           {}, // private key of certs
+	"sk":            {},
+	"secretkey":     {},
+	"password":      {},
+	"token":         {},
+	"authorization": {},
+	"timeaclkeys":   {}, // keys of timestamp-based anti-leech
+}
+
+var pemPrivateKeyRE = regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`)
+
+// redactBody returns the body in a form suitable for logging.
+func redactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var obj any
+	err := json.Unmarshal(body, &obj)
+	if err == nil {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		err = enc.Encode(redactJSONValue(obj))
+		if err == nil {
+			return maskRegisteredSecrets(strings.TrimSpace(buf.String()))
+		}
+	}
+
+	// not JSON, fall back to masking what we can recognize
+	s := pemPrivateKeyRE.ReplaceAllString(string(body), redacted)
+	return maskRegisteredSecrets(s)
+}
+
+func redactJSONValue(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, val := range x {
+			if _, ok := sensitiveJSONKeys[strings.ToLower(k)]; ok {
+				x[k] = redacted
+				continue
+			}
+			x[k] = redactJSONValue(val)
+		}
+		return x
+	case []any:
+		for i, val := range x {
+			x[i] = redactJSONValue(val)
+		}
+		return x
+	case string:
+		return pemPrivateKeyRE.ReplaceAllString(x, redacted)
+	default:
+		return v
+	}
+}
+
+func redactHeaders(h http.Header) http.Header {
+	result := h.Clone()
+	for k := range result {
+		if _, ok := sensitiveJSONKeys[strings.ToLower(k)]; ok {
+			result[k] = []string{redacted}
+		}
+	}
+	return result
+}
+
+// traceHTTP logs one finished HTTP exchange. resp and respBody are nil if the
+// request failed at the transport level.
+func traceHTTP(
+	req *http.Request,
+	reqBody []byte,
+	resp *http.Response,
+	respBody []byte,
+	latency time.Duration,
+	err error,
+) {
+	ctx := req.Context()
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", req.Method),
+		slog.String("url", req.URL.String()),
+		slog.Duration("latency", latency),
+	}
+	if resp != nil {
+		attrs = append(
+			attrs,
+			slog.Int("status", resp.StatusCode),
+			slog.String("reqID", resp.Header.Get("X-Reqid")),
+		)
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("err", err))
+	}
+
+	if traceBodies.Load() {
+		attrs = append(
+			attrs,
+			slog.Any("reqHeaders", redactHeaders(req.Header)),
+			slog.String("reqBody", redactBody(reqBody)),
+		)
+		if resp != nil {
+			attrs = append(attrs, slog.String("respBody", redactBody(respBody)))
+		}
+	}
+
+	slog.LogAttrs(ctx, slog.LevelDebug, "HTTP call", attrs...)
+}
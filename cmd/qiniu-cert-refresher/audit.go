@@ -0,0 +1,331 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+const defaultAuditSyslogTag = "qiniu-cert-refresher"
+
+// auditRecord is one line of the audit log. The hash of every record covers
+// the hash of the previous one, so that modifying or removing records breaks
+// the chain.
+type auditRecord struct {
+	Time     time.Time         `json:"time"`
+	Op       qcdn.AuditOp      `json:"op"`
+	Account  string            `json:"account"`
+	AK       string            `json:"ak"`
+	User     string            `json:"user"`
+	Host     string            `json:"host"`
+	Domain   string            `json:"domain,omitempty"`
+	ConfKind string            `json:"confKind,omitempty"`
+	CertID   string            `json:"certID,omitempty"`
+	CertName string            `json:"certName,omitempty"`
+	OldHTTPS *qcdn.HTTPSConfig `json:"oldHTTPS,omitempty"`
+	NewHTTPS *qcdn.HTTPSConfig `json:"newHTTPS,omitempty"`
+	Result   string            `json:"result"`
+	Error    string            `json:"error,omitempty"`
+	Prev     string            `json:"prev"`
+	// the hash is appended textually after the rest is serialized, see
+	// (*auditSink).write
+}
+
+const (
+	auditResultOK     = "ok"
+	auditResultFailed = "failed"
+)
+
+// auditForwarder additionally sends the records elsewhere, such as syslog.
+type auditForwarder interface {
+	Info(m string) error
+}
+
+// auditSink appends audit records to a file, and optionally forwards them.
+// The chain is only kept intact within one process, so concurrent runs must
+// not share an audit log file.
+type auditSink struct {
+	// accountNames maps AKs to the names of the accounts using them
+	accountNames map[string]string
+	user         string
+	host         string
+
+	mu       sync.Mutex
+	f        *os.File
+	prevHash string
+	fwd      auditForwarder
+}
+
+// setupAudit starts auditing the mutating API calls according to cfg.
+func setupAudit(cfg *Config) error {
+	if cfg.Audit == nil || (len(cfg.Audit.File) == 0 && !cfg.Audit.Syslog) {
+		return nil
+	}
+
+	s := auditSink{
+		accountNames: make(map[string]string),
+		user:         currentUsername(),
+	}
+	s.host, _ = os.Hostname()
+	for _, acc := range cfg.Accounts {
+		if names, ok := s.accountNames[acc.AK]; ok {
+			s.accountNames[acc.AK] = names + "," + acc.DisplayName
+			continue
+		}
+		s.accountNames[acc.AK] = acc.DisplayName
+	}
+
+	if len(cfg.Audit.File) > 0 {
+		prevHash, err := lastAuditHash(cfg.Audit.File)
+		if errors.Is(err, errMalformedAuditTail) {
+			// most likely torn by a crash; the break is left for audit
+			// verify to report, instead of failing every command
+			slog.Warn("cannot continue the audit log chain, starting a new segment", "err", err)
+			prevHash, err = "", nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot continue the audit log: %w", err)
+		}
+		s.prevHash = prevHash
+
+		s.f, err = os.OpenFile(cfg.Audit.File, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("cannot open the audit log: %w", err)
+		}
+		err = terminateLastLine(s.f)
+		if err != nil {
+			return fmt.Errorf("cannot open the audit log: %w", err)
+		}
+	}
+
+	if cfg.Audit.Syslog {
+		tag := cfg.Audit.SyslogTag
+		if len(tag) == 0 {
+			tag = defaultAuditSyslogTag
+		}
+
+		fwd, err := newSyslogAuditForwarder(tag)
+		if err != nil {
+			return fmt.Errorf("cannot connect to syslog: %w", err)
+		}
+		s.fwd = fwd
+	}
+
+	slog.Debug("audit logging enabled", "file", cfg.Audit.File, "syslog", cfg.Audit.Syslog)
+	qcdn.SetAuditHook(s.record)
+	return nil
+}
+
+func currentUsername() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+func (s *auditSink) record(e *qcdn.AuditEvent) {
+	r := auditRecord{
+		Time:     e.Time,
+		Op:       e.Op,
+		Account:  s.accountNames[e.AK],
+		AK:       e.AK,
+		User:     s.user,
+		Host:     s.host,
+		Domain:   e.Domain,
+		ConfKind: e.ConfKind,
+		CertID:   e.CertID,
+		CertName: e.CertName,
+		OldHTTPS: e.OldHTTPS,
+		NewHTTPS: e.NewHTTPS,
+		Result:   auditResultOK,
+	}
+	if e.Err != nil {
+		r.Result = auditResultFailed
+		r.Error = e.Err.Error()
+	}
+
+	err := s.write(&r)
+	if err != nil {
+		// the call is already made, so there's nothing left but to shout
+		slog.Error("failed to write audit record", "op", r.Op, "domain", r.Domain, "certID", r.CertID, "err", err)
+	}
+}
+
+func (s *auditSink) write(r *auditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.Prev = s.prevHash
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	hash := auditHash(body)
+	line := sealAuditRecord(body, hash)
+
+	if s.f != nil {
+		_, err = s.f.Write(append(line, '\n'))
+		if err != nil {
+			return err
+		}
+		err = s.f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	s.prevHash = hash
+
+	if s.fwd != nil {
+		err = s.fwd.Info(string(line))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// auditHash hashes a serialized record without its hash. As the record
+// contains the previous hash, so does the hash cover the whole chain.
+func auditHash(body []byte) string {
+	h := sha256.Sum256(body)
+	return hex.EncodeToString(h[:])
+}
+
+// sealAuditRecord appends the hash to the serialized record as the last
+// field.
+func sealAuditRecord(body []byte, hash string) []byte {
+	var sb strings.Builder
+	sb.Write(body[:len(body)-1]) // without the closing brace
+	sb.WriteString(`,"hash":"`)
+	sb.WriteString(hash)
+	sb.WriteString(`"}`)
+	return []byte(sb.String())
+}
+
+var sealedAuditRecordRE = regexp.MustCompile(`^(.*),"hash":"([0-9a-f]{64})"\}$`)
+
+// unsealAuditRecord splits a line of the audit log into the serialized
+// record without its hash, and the hash.
+func unsealAuditRecord(line string) (body []byte, hash string, ok bool) {
+	m := sealedAuditRecordRE.FindStringSubmatch(line)
+	if m == nil {
+		return nil, "", false
+	}
+	return []byte(m[1] + "}"), m[2], true
+}
+
+var errMalformedAuditTail = errors.New("malformed last record")
+
+// lastAuditHash returns the hash of the last record of the audit log at
+// path, or "" if the log is empty or doesn't exist yet.
+func lastAuditHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	var last string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if len(sc.Bytes()) > 0 {
+			last = sc.Text()
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	if len(last) == 0 {
+		return "", nil
+	}
+
+	_, hash, ok := unsealAuditRecord(last)
+	if !ok {
+		return "", fmt.Errorf("%s: %w", path, errMalformedAuditTail)
+	}
+	return hash, nil
+}
+
+// terminateLastLine appends a newline to f if its last line is torn, so that
+// new records don't get glued to it.
+func terminateLastLine(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return nil
+	}
+
+	var last [1]byte
+	_, err = f.ReadAt(last[:], fi.Size()-1)
+	if err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = f.Write([]byte{'\n'})
+	return err
+}
+
+// verifyAuditLog checks the hash chain of the audit log at path, returning
+// the number of records checked.
+func verifyAuditLog(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	prevHash := ""
+	n := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		n++
+		body, hash, ok := unsealAuditRecord(sc.Text())
+		if !ok {
+			return n - 1, fmt.Errorf("%s:%d: malformed record", path, n)
+		}
+
+		var r auditRecord
+		err := json.Unmarshal(body, &r)
+		if err != nil {
+			return n - 1, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if r.Prev != prevHash {
+			return n - 1, fmt.Errorf("%s:%d: chain broken, previous record missing or altered", path, n)
+		}
+		if auditHash(body) != hash {
+			return n - 1, fmt.Errorf("%s:%d: hash mismatch, record altered", path, n)
+		}
+
+		prevHash = hash
+	}
+	if err := sc.Err(); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
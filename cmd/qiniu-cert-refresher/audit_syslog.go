@@ -0,0 +1,11 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !windows && !plan9
+
+package main
+
+import "log/syslog"
+
+func newSyslogAuditForwarder(tag string) (auditForwarder, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, tag)
+}
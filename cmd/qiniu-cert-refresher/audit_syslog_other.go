@@ -0,0 +1,11 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+func newSyslogAuditForwarder(tag string) (auditForwarder, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
@@ -0,0 +1,414 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// certInput is a cert chain with its private key, normalized to the PEM
+// encodings expected by qcdn.ReqUploadCert.
+type certInput struct {
+	// chainPEM is the leaf cert followed by the intermediates
+	chainPEM []byte
+	keyPEM   []byte
+	leaf     *x509.Certificate
+}
+
+var errEncryptedKey = errors.New(
+	"the private key is encrypted, please give its passphrase with " +
+		"--pem-passphrase-file, --pem-passphrase-env or --pem-passphrase-command",
+)
+
+// certInputOptions are the things needed for reading some of the inputs.
+type certInputOptions struct {
+	// p12PasswordFile may be empty if the PKCS#12 file is not protected with
+	// a password
+	p12PasswordFile string
+	// keyPassphrase obtains the passphrase of an encrypted private key, and is
+	// only called if the key turns out encrypted. It may be nil if no
+	// passphrase is given.
+	keyPassphrase func() ([]byte, error)
+	// chain configures the completion of the cert chain, and may be nil
+	chain *ChainConfig
+}
+
+// loadCertInput reads the cert chain and private key from the given files,
+// accepting PEM (possibly with the key bundled), DER and PKCS#12 inputs, with
+// encrypted keys decrypted. keyPath may be empty if the key is contained in
+// the cert file. The chain is completed and ordered as configured in opts.
+func loadCertInput(
+	ctx context.Context,
+	certPath string,
+	keyPath string,
+	opts *certInputOptions,
+) (*certInput, error) {
+	certData, err := readFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if isPKCS12Input(certPath, certData) {
+		if len(keyPath) > 0 {
+			return nil, errors.New("a separate private key file cannot be used with PKCS#12 input")
+		}
+		return loadPKCS12Input(ctx, certPath, certData, opts)
+	}
+
+	certs, bundledKeys, err := parseCertsPEMOrDER(certData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificate in input", certPath)
+	}
+
+	var key crypto.PrivateKey
+	var keyPEM []byte
+	switch {
+	case len(keyPath) > 0:
+		keyData, err := readFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		key, keyPEM, err = parsePrivateKeyPEMOrDER(keyData, opts.keyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyPath, err)
+		}
+
+	case len(bundledKeys) > 0:
+		key, keyPEM, err = parsePrivateKeyPEMBlock(bundledKeys[0], opts.keyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", certPath, err)
+		}
+
+	default:
+		return nil, errors.New("a private key file must be given, unless the key is bundled with the certificate")
+	}
+
+	return newCertInput(ctx, key, keyPEM, certs, opts.chain)
+}
+
+// newCertInput picks the leaf matching key out of certs, which may come in
+// any order, and builds its chain.
+func newCertInput(
+	ctx context.Context,
+	key crypto.PrivateKey,
+	keyPEM []byte,
+	certs []*x509.Certificate,
+	chainCfg *ChainConfig,
+) (*certInput, error) {
+	var leaf *x509.Certificate
+	for _, c := range certs {
+		err := checkKeyMatchesCert(key, c)
+		if err == nil {
+			leaf = c
+			break
+		}
+		if errors.Is(err, errUnsupportedKeyType) {
+			return nil, err
+		}
+	}
+	if leaf == nil {
+		return nil, errors.New("the private key does not match any of the certificates")
+	}
+
+	certs, err := buildChain(ctx, leaf, certs, chainCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain bytes.Buffer
+	for _, c := range certs {
+		err := pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &certInput{
+		chainPEM: chain.Bytes(),
+		keyPEM:   keyPEM,
+		leaf:     leaf,
+	}, nil
+}
+
+func isPKCS12Input(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".p12", ".pfx":
+		return true
+	}
+	return looksLikePFX(data)
+}
+
+// looksLikePFX reports whether data starts like the PFX structure of PKCS#12
+// (RFC 7292), i.e. a SEQUENCE beginning with the version INTEGER 3, while a
+// cert starts with the nested TBSCertificate SEQUENCE instead. The length may
+// be in the indefinite BER form, as produced by some tools.
+func looksLikePFX(data []byte) bool {
+	if len(data) < 2 || data[0] != 0x30 {
+		return false
+	}
+
+	// skip the length octets of the outer SEQUENCE
+	lenOctets := 1
+	if data[1] > 0x80 {
+		lenOctets += int(data[1] & 0x7f)
+	}
+	rest := data[1:]
+	if len(rest) < lenOctets {
+		return false
+	}
+	return bytes.HasPrefix(rest[lenOctets:], []byte{0x02, 0x01, 0x03})
+}
+
+func isPEM(data []byte) bool {
+	return bytes.Contains(data, []byte("-----BEGIN "))
+}
+
+func loadPKCS12Input(
+	ctx context.Context,
+	path string,
+	data []byte,
+	opts *certInputOptions,
+) (*certInput, error) {
+	passwordFile := opts.p12PasswordFile
+	password := ""
+	if len(passwordFile) > 0 {
+		var err error
+		password, err = readSecretFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key, leaf, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		if errors.Is(err, pkcs12.ErrIncorrectPassword) || errors.Is(err, pkcs12.ErrDecryption) {
+			if len(passwordFile) == 0 {
+				return nil, fmt.Errorf(
+					"%s is password-protected, please give the password with --p12-password-file",
+					path,
+				)
+			}
+			return nil, fmt.Errorf("%s: wrong password", path)
+		}
+		return nil, fmt.Errorf("%s: not a usable PKCS#12 file: %w", path, err)
+	}
+
+	keyPEM, err := encodePKCS8PEM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCertInput(ctx, key, keyPEM, append([]*x509.Certificate{leaf}, caCerts...), opts.chain)
+}
+
+func encodePKCS8PEM(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// parseCertsPEMOrDER parses the certs in data, also returning the private
+// key blocks if data is a PEM bundle.
+func parseCertsPEMOrDER(data []byte) ([]*x509.Certificate, []*pem.Block, error) {
+	if !isPEM(data) {
+		certs, err := x509.ParseCertificates(data)
+		return certs, nil, err
+	}
+
+	var certs []*x509.Certificate
+	var keys []*pem.Block
+	for len(data) > 0 {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, cert)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			keys = append(keys, block)
+		}
+	}
+
+	return certs, keys, nil
+}
+
+// parsePrivateKeyPEMOrDER parses the private key in data, returning it along
+// with its unencrypted PEM encoding.
+func parsePrivateKeyPEMOrDER(
+	data []byte,
+	passphrase func() ([]byte, error),
+) (crypto.PrivateKey, []byte, error) {
+	if !isPEM(data) {
+		if isEncryptedPKCS8(data) {
+			return decryptPrivateKey(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: data}, passphrase)
+		}
+		return parsePrivateKeyDER(data)
+	}
+
+	for len(data) > 0 {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return parsePrivateKeyPEMBlock(block, passphrase)
+		}
+	}
+
+	return nil, nil, errors.New("no private key in input")
+}
+
+func parsePrivateKeyPEMBlock(
+	block *pem.Block,
+	passphrase func() ([]byte, error),
+) (crypto.PrivateKey, []byte, error) {
+	if isEncryptedPEMBlock(block) {
+		return decryptPrivateKey(block, passphrase)
+	}
+	return parsePrivateKeyDER(block.Bytes)
+}
+
+// decryptPrivateKey decrypts the encrypted key block, returning the key with
+// its unencrypted PKCS#8 PEM encoding, which is kept in memory only.
+func decryptPrivateKey(
+	block *pem.Block,
+	passphrase func() ([]byte, error),
+) (crypto.PrivateKey, []byte, error) {
+	if passphrase == nil {
+		return nil, nil, errEncryptedKey
+	}
+	pass, err := passphrase()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get the private key passphrase: %w", err)
+	}
+
+	der, err := decryptPrivateKeyPEMBlock(block, pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, _, err := parsePrivateKeyDER(der)
+	if err != nil {
+		// a wrong passphrase may well produce valid padding by chance
+		return nil, nil, errWrongPassphrase
+	}
+
+	keyPEM, err := encodePKCS8PEM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, keyPEM, nil
+}
+
+func isEncryptedPEMBlock(block *pem.Block) bool {
+	return block.Type == "ENCRYPTED PRIVATE KEY" ||
+		strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")
+}
+
+// parsePrivateKeyDER tries the DER encodings of private keys in turn,
+// returning the key with its PEM encoding.
+func parsePrivateKeyDER(der []byte) (crypto.PrivateKey, []byte, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}), nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+	return nil, nil, errors.New("unrecognized private key format")
+}
+
+var errUnsupportedKeyType = errors.New("unsupported private key type")
+
+func checkKeyMatchesCert(key crypto.PrivateKey, cert *x509.Certificate) error {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errUnsupportedKeyType
+	}
+
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return errors.New("the private key does not match the certificate")
+	}
+	return nil
+}
+
+// makeCertInputOptions collects the cert input options from the command
+// line, and the chain completion config, which the command line overrides.
+func makeCertInputOptions(cCtx *cli.Context) (*certInputOptions, error) {
+	opts := certInputOptions{p12PasswordFile: cCtx.Path("p12-password-file")}
+
+	var chainCfg ChainConfig
+	if c := getConfig(cCtx.Context).Chain; c != nil {
+		chainCfg = *c
+	}
+	if cCtx.IsSet("intermediates-dir") {
+		chainCfg.IntermediatesDir = cCtx.Path("intermediates-dir")
+	}
+	if cCtx.IsSet("fetch-aia") {
+		chainCfg.FetchAIA = cCtx.Bool("fetch-aia")
+	}
+	opts.chain = &chainCfg
+
+	passFile := cCtx.Path("pem-passphrase-file")
+	passEnv := cCtx.String("pem-passphrase-env")
+	passCommand := cCtx.String("pem-passphrase-command")
+	numSources := 0
+	for _, s := range []string{passFile, passEnv, passCommand} {
+		if len(s) > 0 {
+			numSources++
+		}
+	}
+	if numSources > 1 {
+		return nil, errors.New("only one source of the private key passphrase can be given")
+	}
+
+	switch {
+	case len(passFile) > 0:
+		opts.keyPassphrase = func() ([]byte, error) {
+			s, err := readSecretFile(passFile)
+			return []byte(s), err
+		}
+	case len(passEnv) > 0:
+		opts.keyPassphrase = func() ([]byte, error) {
+			s, ok := os.LookupEnv(passEnv)
+			if !ok {
+				return nil, fmt.Errorf("environment variable %s is not set", passEnv)
+			}
+			return []byte(s), nil
+		}
+	case len(passCommand) > 0:
+		opts.keyPassphrase = func() ([]byte, error) {
+			s, err := runSecretCommand(cCtx.Context, passCommand)
+			return []byte(s), err
+		}
+	}
+
+	return &opts, nil
+}
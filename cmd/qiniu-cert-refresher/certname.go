@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+// defaultCertNameTemplate names certs like
+// "[QCR-Managed] example.com [ecdsa] 20260102 0123abcd".
+const defaultCertNameTemplate = "{{.Prefix}} {{.Key}} [{{.KeyType}}] {{.Date}} {{.Fingerprint}}"
+
+// certNameData is what cert names are rendered from.
+type certNameData struct {
+	Prefix  string
+	Key     string
+	KeyType string
+	// Date is the issue date of the cert, as YYYYMMDD in UTC
+	Date string
+	// Fingerprint is the first 8 hex digits of the SHA-256 of the cert
+	Fingerprint string
+	// Timestamp is the upload time in Unix nanoseconds
+	Timestamp string
+}
+
+// managedCertName is what can be recovered from the name of a managed cert.
+// Fields other than Key may be empty if not part of the name format.
+type managedCertName struct {
+	Key         string
+	KeyType     certKeyType
+	Date        string
+	Fingerprint string
+}
+
+// certNameFields are the fields of certNameData, with the patterns they are
+// parsed back with.
+var certNameFields = []struct {
+	name    string
+	pattern string
+}{
+	{"Prefix", ""}, // matched literally
+	{"Key", `.+?`},
+	{"KeyType", `rsa|ecdsa`},
+	{"Date", `\d{8}`},
+	{"Fingerprint", `[0-9a-f]{8}`},
+	{"Timestamp", `\d+`},
+}
+
+// certNameFormat renders and parses the names of managed certs for a given
+// prefix and template.
+type certNameFormat struct {
+	prefix string
+	tmpl   *template.Template
+	re     *regexp.Regexp
+	// groups are the certNameData field names of the capture groups of re,
+	// in order; a field may be captured more than once
+	groups []string
+}
+
+// legacyCertNameRE matches the names given by earlier versions, i.e.
+// "<prefix> <key> (<unix nanos>)", optionally with a " [<key type>]" before
+// the timestamp, the prefix being already stripped.
+var legacyCertNameRE = regexp.MustCompile(`^\s*(.+?)(?: \[(rsa|ecdsa)\])? \(\d+\)$`)
+
+func newCertNameFormat(prefix string, tmplText string) (*certNameFormat, error) {
+	if len(tmplText) == 0 {
+		tmplText = defaultCertNameTemplate
+	}
+
+	tmpl, err := template.New("cert name").Option("missingkey=error").Parse(tmplText)
+	if err != nil {
+		return nil, fmt.Errorf("bad cert name template: %w", err)
+	}
+
+	// render with a sentinel for every field, which is then turned into a
+	// capture group, the rest being matched literally
+	sentinels := certNameData{
+		Prefix:      "\x00Prefix\x00",
+		Key:         "\x00Key\x00",
+		KeyType:     "\x00KeyType\x00",
+		Date:        "\x00Date\x00",
+		Fingerprint: "\x00Fingerprint\x00",
+		Timestamp:   "\x00Timestamp\x00",
+	}
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, &sentinels)
+	if err != nil {
+		return nil, fmt.Errorf("bad cert name template: %w", err)
+	}
+	rendered := sb.String()
+
+	result := certNameFormat{prefix: prefix, tmpl: tmpl}
+	var re strings.Builder
+	re.WriteRune('^')
+	for i, part := range strings.Split(rendered, "\x00") {
+		if i%2 == 0 {
+			re.WriteString(regexp.QuoteMeta(part))
+			continue
+		}
+
+		pattern := ""
+		found := false
+		for _, f := range certNameFields {
+			if f.name == part {
+				pattern, found = f.pattern, true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("bad cert name template: fields must be used verbatim")
+		}
+
+		if part == "Prefix" {
+			re.WriteString(regexp.QuoteMeta(prefix))
+			continue
+		}
+		re.WriteString("(" + pattern + ")")
+		result.groups = append(result.groups, part)
+	}
+	re.WriteRune('$')
+
+	if !strings.Contains(rendered, sentinels.Prefix) || !strings.Contains(rendered, sentinels.Key) {
+		return nil, errors.New("bad cert name template: both {{.Prefix}} and {{.Key}} must be used")
+	}
+
+	result.re, err = regexp.Compile(re.String())
+	if err != nil {
+		return nil, fmt.Errorf("bad cert name template: %w", err)
+	}
+	return &result, nil
+}
+
+// render names the leaf cert of the given key type for the tracing key. The
+// name is checked to parse back to the same tracing key, which could fail
+// with some unfortunate combinations of the template and the key.
+func (f *certNameFormat) render(
+	key string,
+	keyType certKeyType,
+	leaf *x509.Certificate,
+	now time.Time,
+) (string, error) {
+	fp := sha256.Sum256(leaf.Raw)
+	data := certNameData{
+		Prefix:      f.prefix,
+		Key:         key,
+		KeyType:     string(keyType),
+		Date:        leaf.NotBefore.UTC().Format("20060102"),
+		Fingerprint: hex.EncodeToString(fp[:4]),
+		Timestamp:   strconv.FormatInt(now.UnixNano(), 10),
+	}
+
+	var sb strings.Builder
+	err := f.tmpl.Execute(&sb, &data)
+	if err != nil {
+		return "", err
+	}
+	name := sb.String()
+
+	parsed, ok := f.parse(name)
+	if !ok || parsed.Key != key {
+		return "", fmt.Errorf("cert name '%s' would not parse back to tracing key '%s'", name, key)
+	}
+	return name, nil
+}
+
+// parse recovers the metadata from the name of a managed cert, falling back
+// to the format of earlier versions. ok is false if the cert is not managed
+// under the prefix. Templates loose enough to match the old format as well,
+// like "{{.Prefix}} {{.Key}}", take precedence and thus break the fallback.
+func (f *certNameFormat) parse(name string) (*managedCertName, bool) {
+	if m := f.re.FindStringSubmatch(name); m != nil {
+		values := make(map[string]string)
+		for i, field := range f.groups {
+			v := m[i+1]
+			if prev, ok := values[field]; ok && prev != v {
+				// a field used more than once must be consistent
+				return nil, false
+			}
+			values[field] = v
+		}
+
+		return &managedCertName{
+			Key:         values["Key"],
+			KeyType:     certKeyType(values["KeyType"]),
+			Date:        values["Date"],
+			Fingerprint: values["Fingerprint"],
+		}, true
+	}
+
+	rest, ok := strings.CutPrefix(name, f.prefix)
+	if !ok {
+		return nil, false
+	}
+	m := legacyCertNameRE.FindStringSubmatch(rest)
+	if m == nil {
+		return nil, false
+	}
+	return &managedCertName{Key: m[1], KeyType: certKeyType(m[2])}, true
+}
+
+// tracingKeyOfCert returns the tracing key and key type of the cert, be it
+// managed or adopted. ok is false if the cert is neither.
+func (x *AccountConfig) tracingKeyOfCert(c *qcdn.Cert) (string, certKeyType, bool) {
+	if n, ok := x.certNames.parse(c.Name); ok {
+		return n.Key, n.KeyType, true
+	}
+	if a, ok := x.adopted[c.ID]; ok {
+		return a.Key, a.KeyType, true
+	}
+	return "", "", false
+}
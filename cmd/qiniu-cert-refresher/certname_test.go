@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestCertNameRoundTrip(t *testing.T) {
+	leaf := &x509.Certificate{
+		// only hashed for the fingerprint
+		Raw:       []byte("not really a cert"),
+		NotBefore: time.Date(2026, 1, 2, 23, 0, 0, 0, time.FixedZone("UTC-2", -2*3600)),
+	}
+	const wantDate = "20260103"
+	const wantFingerprint = "67f4dce8"
+
+	templates := []string{
+		"", // the default
+		"{{.Prefix}} {{.Key}} ({{.Timestamp}})",
+		"{{.Prefix}}-{{.KeyType}}-{{.Key}}-{{.Fingerprint}}",
+		"{{.Key}} @ {{.Prefix}} {{.Date}}",
+	}
+	keys := []string{"example.com", "foo", "foo bar", "*.example.com", "a [rsa] b"}
+
+	for _, tmpl := range templates {
+		f, err := newCertNameFormat(defaultManagedCertNamePrefix, tmpl)
+		if err != nil {
+			t.Fatalf("template %q: %v", tmpl, err)
+		}
+		for _, key := range keys {
+			for _, kt := range []certKeyType{certKeyTypeRSA, certKeyTypeECDSA} {
+				name, err := f.render(key, kt, leaf, time.Unix(1700000000, 0))
+				if err != nil {
+					t.Errorf("template %q, key %q: %v", tmpl, key, err)
+					continue
+				}
+
+				n, ok := f.parse(name)
+				if !ok {
+					t.Errorf("%q not parsed back", name)
+					continue
+				}
+				if n.Key != key {
+					t.Errorf("%q parsed to key %q, want %q", name, n.Key, key)
+				}
+				want := map[string]string{
+					"KeyType":     string(kt),
+					"Date":        wantDate,
+					"Fingerprint": wantFingerprint,
+				}
+				got := map[string]string{
+					"KeyType":     string(n.KeyType),
+					"Date":        n.Date,
+					"Fingerprint": n.Fingerprint,
+				}
+				for _, field := range f.groups {
+					if w, ok := want[field]; ok && got[field] != w {
+						t.Errorf("%q parsed to %s %q, want %q", name, field, got[field], w)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCertNameParse(t *testing.T) {
+	testcases := []struct {
+		name     string
+		prefix   string
+		tmpl     string
+		certName string
+		wantKey  string
+		wantKT   certKeyType
+		wantOK   bool
+	}{
+		{
+			name:     "default format",
+			certName: "[QCR-Managed] example.com [ecdsa] 20260102 0123abcd",
+			wantKey:  "example.com",
+			wantKT:   certKeyTypeECDSA,
+			wantOK:   true,
+		},
+		{
+			name:     "key extending another key",
+			certName: "[QCR-Managed] foobar [rsa] 20260102 0123abcd",
+			wantKey:  "foobar",
+			wantKT:   certKeyTypeRSA,
+			wantOK:   true,
+		},
+		{
+			name:     "key with spaces",
+			certName: "[QCR-Managed] foo bar [rsa] 20260102 0123abcd",
+			wantKey:  "foo bar",
+			wantKT:   certKeyTypeRSA,
+			wantOK:   true,
+		},
+		{
+			name:     "unknown key type",
+			certName: "[QCR-Managed] foo [dsa] 20260102 0123abcd",
+			wantOK:   false,
+		},
+		{
+			name:     "uppercase fingerprint",
+			certName: "[QCR-Managed] foo [rsa] 20260102 0123ABCD",
+			wantOK:   false,
+		},
+		{
+			name:     "another prefix",
+			certName: "[Other] foo [rsa] 20260102 0123abcd",
+			wantOK:   false,
+		},
+		{
+			name:     "custom prefix",
+			prefix:   "team-a",
+			certName: "team-a foo [rsa] 20260102 0123abcd",
+			wantKey:  "foo",
+			wantKT:   certKeyTypeRSA,
+			wantOK:   true,
+		},
+		{
+			name:     "prefix extending the prefix",
+			prefix:   "team-a",
+			certName: "team-ab foo [rsa] 20260102 0123abcd",
+			wantOK:   false,
+		},
+		{
+			name:     "legacy",
+			certName: "[QCR-Managed] example.com (1700000000000000000)",
+			wantKey:  "example.com",
+			wantOK:   true,
+		},
+		{
+			name:     "legacy extending another key",
+			certName: "[QCR-Managed] foobar (1700000000000000000)",
+			wantKey:  "foobar",
+			wantOK:   true,
+		},
+		{
+			name:     "legacy with key type",
+			certName: "[QCR-Managed] example.com [ecdsa] (1700000000000000000)",
+			wantKey:  "example.com",
+			wantKT:   certKeyTypeECDSA,
+			wantOK:   true,
+		},
+		{
+			name:     "legacy without the separating space",
+			certName: "[QCR-Managed]example.com (1700000000000000000)",
+			wantKey:  "example.com",
+			wantOK:   true,
+		},
+		{
+			name:     "legacy without timestamp",
+			certName: "[QCR-Managed] example.com",
+			wantOK:   false,
+		},
+		{
+			name:     "custom template",
+			tmpl:     "{{.Key}}/{{.KeyType}}/{{.Prefix}}",
+			certName: "foo.example.com/rsa/[QCR-Managed]",
+			wantKey:  "foo.example.com",
+			wantKT:   certKeyTypeRSA,
+			wantOK:   true,
+		},
+		{
+			name:     "field used twice inconsistently",
+			tmpl:     "{{.Prefix}} {{.Key}} {{.KeyType}} {{.KeyType}}",
+			certName: "[QCR-Managed] foo rsa ecdsa",
+			wantOK:   false,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			prefix := tc.prefix
+			if len(prefix) == 0 {
+				prefix = defaultManagedCertNamePrefix
+			}
+			f, err := newCertNameFormat(prefix, tc.tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, ok := f.parse(tc.certName)
+			if ok != tc.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if n.Key != tc.wantKey || n.KeyType != tc.wantKT {
+				t.Errorf("parsed to %q [%s], want %q [%s]", n.Key, n.KeyType, tc.wantKey, tc.wantKT)
+			}
+		})
+	}
+}
+
+func TestCertNameBadTemplates(t *testing.T) {
+	for _, tmpl := range []string{
+		"{{.Key}}",    // no prefix
+		"{{.Prefix}}", // no key
+		"{{.Prefix}} {{.Key}} {{.Unknown}}",
+		"{{.Prefix}} {{.Key | printf \"%q\"}}",
+		"{{.Prefix}} {{.Key",
+	} {
+		_, err := newCertNameFormat(defaultManagedCertNamePrefix, tmpl)
+		if err == nil {
+			t.Errorf("template %q accepted", tmpl)
+		}
+	}
+}
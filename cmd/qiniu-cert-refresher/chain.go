@@ -0,0 +1,280 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	maxChainLength  = 10
+	aiaFetchTimeout = 10 * time.Second
+	aiaMaxSize      = 1 << 20
+)
+
+// ChainConfig 证书链补全配置
+type ChainConfig struct {
+	// IntermediatesDir 存放中间证书（PEM 或 DER 格式）的目录，用于补全不完整的证书链
+	IntermediatesDir string `toml:"intermediates_dir" yaml:"intermediates_dir" json:"intermediates_dir"`
+	// FetchAIA 是否按证书 AIA 扩展中的 caIssuers 地址下载缺失的中间证书
+	FetchAIA bool `toml:"fetch_aia" yaml:"fetch_aia" json:"fetch_aia"`
+
+	// aiaClient is used for fetching issuers via AIA, http.DefaultClient if
+	// nil
+	aiaClient *http.Client
+}
+
+func (x *ChainConfig) httpClient() *http.Client {
+	if x.aiaClient == nil {
+		return http.DefaultClient
+	}
+	return x.aiaClient
+}
+
+// buildChain returns the chain of leaf in order, from leaf up to but
+// excluding the root, taking the issuers from the given certs, then the
+// intermediates dir, then AIA if enabled. An incomplete chain is returned as
+// far as it goes, with a warning.
+func buildChain(
+	ctx context.Context,
+	leaf *x509.Certificate,
+	given []*x509.Certificate,
+	cfg *ChainConfig,
+) ([]*x509.Certificate, error) {
+	pool := slices.Clone(given)
+	if cfg != nil && len(cfg.IntermediatesDir) > 0 {
+		certs, err := loadIntermediatesDir(cfg.IntermediatesDir)
+		if err != nil {
+			return nil, err
+		}
+		pool = append(pool, certs...)
+	}
+	fetchAIA := cfg != nil && cfg.FetchAIA
+
+	chain := []*x509.Certificate{leaf}
+	cur := leaf
+	for len(chain) < maxChainLength && !isSelfSigned(cur) {
+		issuer := findIssuer(cur, pool)
+		if issuer == nil && fetchAIA {
+			fetched := fetchAIAIssuers(ctx, cfg.httpClient(), cur)
+			issuer = findIssuer(cur, fetched)
+		}
+		if issuer == nil {
+			break
+		}
+
+		if !slices.ContainsFunc(given, issuer.Equal) {
+			slog.Info("completing the chain", "subject", issuer.Subject.String())
+		}
+		chain = append(chain, issuer)
+		cur = issuer
+	}
+
+	// the root is useless to clients, that have to trust it on their own
+	if len(chain) > 1 && isSelfSigned(cur) {
+		slog.Debug("stripping the root from the chain", "subject", cur.Subject.String())
+		chain = chain[:len(chain)-1]
+	} else if !isSelfSigned(cur) {
+		warnIfUnverifiable(leaf, chain)
+	}
+
+	for _, c := range given {
+		if !slices.ContainsFunc(chain, c.Equal) && !isSelfSigned(c) {
+			slog.Warn("dropping certificate not in the chain", "subject", c.Subject.String())
+		}
+	}
+
+	return chain, nil
+}
+
+func isSelfSigned(c *x509.Certificate) bool {
+	return bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil
+}
+
+func findIssuer(c *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, cand := range candidates {
+		if cand.Equal(c) || !bytes.Equal(c.RawIssuer, cand.RawSubject) {
+			continue
+		}
+		if c.CheckSignatureFrom(cand) == nil {
+			return cand
+		}
+	}
+	return nil
+}
+
+// warnIfUnverifiable warns if the possibly incomplete chain does not verify
+// against the system roots, as Qiniu is likely to reject it.
+func warnIfUnverifiable(leaf *x509.Certificate, chain []*x509.Certificate) {
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		slog.Warn(
+			"the certificate chain seems incomplete, consider configuring an intermediates dir or AIA fetching",
+			"subject", chain[len(chain)-1].Subject.String(),
+			"err", err,
+		)
+	}
+}
+
+func loadIntermediatesDir(dir string) ([]*x509.Certificate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*x509.Certificate
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		data, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		certs, _, err := parseCertsPEMOrDER(data)
+		if err != nil {
+			slog.Debug("ignoring non-certificate file in intermediates dir", "path", path, "err", err)
+			continue
+		}
+		result = append(result, certs...)
+	}
+
+	slog.Debug("loaded intermediates", "dir", dir, "count", len(result))
+	return result, nil
+}
+
+// fetchAIAIssuers downloads the issuers of c from the caIssuers URLs of its
+// AIA extension. Failures are only logged, as the chain may still be usable.
+func fetchAIAIssuers(ctx context.Context, client *http.Client, c *x509.Certificate) []*x509.Certificate {
+	var result []*x509.Certificate
+	for _, u := range c.IssuingCertificateURL {
+		certs, err := fetchAIAIssuer(ctx, client, u)
+		if err != nil {
+			slog.Warn("failed to fetch issuer via AIA", "url", u, "err", err)
+			continue
+		}
+		result = append(result, certs...)
+	}
+	return result
+}
+
+// fetchAIAIssuer downloads the certs at rawURL, which may be DER or PEM
+// encoded, or a PKCS#7 bundle (.p7c) as used by some CAs.
+func fetchAIAIssuer(ctx context.Context, client *http.Client, rawURL string) ([]*x509.Certificate, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, aiaFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("fetching issuer via AIA", "url", rawURL)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, aiaMaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	certs, _, err := parseCertsPEMOrDER(data)
+	if err == nil && len(certs) > 0 {
+		return certs, nil
+	}
+	if certs, p7err := parsePKCS7Certs(data); p7err == nil {
+		return certs, nil
+	}
+	return nil, fmt.Errorf(
+		"unsupported format (Content-Type '%s'), expected DER or PEM certificates or DER PKCS#7",
+		resp.Header.Get("Content-Type"),
+	)
+}
+
+// pkcs7ContentInfo is the outermost structure of PKCS#7 (RFC 2315).
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// pkcs7SignedData is only parsed for the certificates, as in the degenerate
+// "certs-only" bundles without any signature.
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+var oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// parsePKCS7Certs returns the certs in the DER, or PEM-armored, PKCS#7
+// SignedData. BER encodings are not supported.
+func parsePKCS7Certs(data []byte) ([]*x509.Certificate, error) {
+	if block, _ := pem.Decode(data); block != nil && block.Type == "PKCS7" {
+		data = block.Bytes
+	}
+
+	var ci pkcs7ContentInfo
+	rest, err := asn1.Unmarshal(data, &ci)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after PKCS#7 structure")
+	}
+	if !ci.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("unsupported PKCS#7 content type %s", ci.ContentType)
+	}
+
+	var sd pkcs7SignedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.Certificates.Bytes) == 0 {
+		return nil, errors.New("no certificate in PKCS#7 structure")
+	}
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+}
@@ -0,0 +1,236 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var testSerial int64
+
+// newTestCert issues a cert named cn by parent, or a self-signed one if
+// parent is nil, with the given caIssuers URL if not empty.
+func newTestCert(t *testing.T, cn string, isCA bool, parent *testCert, aiaURL string) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{cn}
+	}
+	if len(aiaURL) > 0 {
+		tmpl.IssuingCertificateURL = []string{aiaURL}
+	}
+
+	parentCert, parentKey := &tmpl, crypto.Signer(key)
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, parentCert, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// aiaServer serves the registered bodies by path, counting the requests.
+type aiaServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	bodies map[string][]byte
+	hits   map[string]int
+}
+
+func newAIAServer(t *testing.T) *aiaServer {
+	t.Helper()
+
+	s := &aiaServer{bodies: make(map[string][]byte), hits: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.hits[r.URL.Path]++
+		body, ok := s.bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *aiaServer) serve(path string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies[path] = body
+}
+
+// testHierarchy issues root -> intermediate -> leaf, with AIA pointing at
+// srv for both issuers.
+func testHierarchy(t *testing.T, srv *aiaServer) (root, inter, leaf *testCert) {
+	root = newTestCert(t, "Test Root", true, nil, "")
+	inter = newTestCert(t, "Test Intermediate", true, root, srv.URL+"/root.cer")
+	leaf = newTestCert(t, "example.com", false, inter, srv.URL+"/inter.cer")
+	return root, inter, leaf
+}
+
+func assertChain(t *testing.T, got []*x509.Certificate, want ...*testCert) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		names := make([]string, len(got))
+		for i, c := range got {
+			names[i] = c.Subject.CommonName
+		}
+		t.Fatalf("chain = %v, want %d cert(s)", names, len(want))
+	}
+	for i := range got {
+		if !got[i].Equal(want[i].cert) {
+			t.Errorf("chain[%d] = %s, want %s", i, got[i].Subject.CommonName, want[i].cert.Subject.CommonName)
+		}
+	}
+}
+
+func TestBuildChainViaAIA(t *testing.T) {
+	srv := newAIAServer(t)
+	root, inter, leaf := testHierarchy(t, srv)
+	srv.serve("/inter.cer", inter.cert.Raw)
+	srv.serve("/root.cer", root.cert.Raw)
+
+	cfg := ChainConfig{FetchAIA: true, aiaClient: srv.Client()}
+	chain, err := buildChain(t.Context(), leaf.cert, nil, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the root is fetched to learn where the chain ends, then stripped
+	assertChain(t, chain, leaf, inter)
+	if srv.hits["/inter.cer"] != 1 || srv.hits["/root.cer"] != 1 {
+		t.Errorf("unexpected AIA requests %v", srv.hits)
+	}
+}
+
+func TestBuildChainOrdersGivenCerts(t *testing.T) {
+	srv := newAIAServer(t)
+	root, inter, leaf := testHierarchy(t, srv)
+
+	chain, err := buildChain(t.Context(), leaf.cert, []*x509.Certificate{root.cert, inter.cert}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertChain(t, chain, leaf, inter)
+	if len(srv.hits) > 0 {
+		t.Errorf("AIA fetched although disabled: %v", srv.hits)
+	}
+}
+
+func TestBuildChainViaAIAPKCS7(t *testing.T) {
+	srv := newAIAServer(t)
+	root, inter, leaf := testHierarchy(t, srv)
+	srv.serve("/inter.cer", testPKCS7Bundle(t, inter.cert))
+	srv.serve("/root.cer", testPKCS7Bundle(t, root.cert))
+
+	cfg := ChainConfig{FetchAIA: true, aiaClient: srv.Client()}
+	chain, err := buildChain(t.Context(), leaf.cert, nil, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertChain(t, chain, leaf, inter)
+}
+
+func TestBuildChainViaAIAUnsupportedFormat(t *testing.T) {
+	srv := newAIAServer(t)
+	_, _, leaf := testHierarchy(t, srv)
+	srv.serve("/inter.cer", []byte("<html>not a cert</html>"))
+
+	cfg := ChainConfig{FetchAIA: true, aiaClient: srv.Client()}
+	chain, err := buildChain(t.Context(), leaf.cert, nil, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// incomplete, but not fatal
+	assertChain(t, chain, leaf)
+
+	_, err = fetchAIAIssuer(t.Context(), srv.Client(), srv.URL+"/inter.cer")
+	if err == nil {
+		t.Error("expected an unsupported format error")
+	}
+}
+
+// testPKCS7Bundle encodes certs as a degenerate PKCS#7 SignedData, like .p7c
+// files.
+func testPKCS7Bundle(t *testing.T, certs ...*x509.Certificate) []byte {
+	t.Helper()
+
+	var raw []byte
+	for _, c := range certs {
+		raw = append(raw, c.Raw...)
+	}
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	dataContentInfo, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+	}{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      asn1.RawValue{FullBytes: dataContentInfo},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      emptySet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
@@ -0,0 +1,277 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+const adoptionStateFile = "adopted.json"
+
+// adoptionState remembers the certs not named as managed ones, but adopted
+// into management under some tracing key, so they are superseded by later
+// uploads just like managed certs.
+type adoptionState struct {
+	// Adopted is keyed by "<AK>/<cert ID>"
+	Adopted map[string]*adoptedCert `json:"adopted"`
+}
+
+type adoptedCert struct {
+	Key     string      `json:"key"`
+	KeyType certKeyType `json:"keyType,omitempty"`
+	// Name is the name of the cert at the time of adoption, for reference
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+func adoptionKey(acc *AccountConfig, certID string) string {
+	return acc.AK + "/" + certID
+}
+
+func loadAdoptionState(path string) (*adoptionState, error) {
+	result := adoptionState{Adopted: make(map[string]*adoptedCert)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &result, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if result.Adopted == nil {
+		result.Adopted = make(map[string]*adoptedCert)
+	}
+	return &result, nil
+}
+
+func (s *adoptionState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// loadAdoptions attaches the recorded adoptions to the accounts.
+func loadAdoptions(cCtx *cli.Context, cfg *Config) error {
+	dir, err := stateDir(cCtx)
+	if err != nil {
+		return err
+	}
+	state, err := loadAdoptionState(filepath.Join(dir, adoptionStateFile))
+	if err != nil {
+		return err
+	}
+
+	for _, acc := range cfg.Accounts {
+		acc.adopted = make(map[string]*adoptedCert)
+		for k, a := range state.Adopted {
+			if ak, certID, _ := strings.Cut(k, "/"); ak == acc.AK {
+				acc.adopted[certID] = a
+			}
+		}
+	}
+	return nil
+}
+
+func cmdAdopt(cCtx *cli.Context) error {
+	key := cCtx.Args().First()
+	if len(key) == 0 {
+		return errors.New("a tracing key must be specified")
+	}
+	certIDs := cCtx.StringSlice("cert-id")
+	patterns := cCtx.StringSlice("match")
+	forget := cCtx.Bool("forget")
+	if len(certIDs) == 0 && len(patterns) == 0 && !forget {
+		return errors.New("at least one of --cert-id and --match must be given")
+	}
+	for _, p := range patterns {
+		_, err := path.Match(p, "")
+		if err != nil {
+			return fmt.Errorf("bad pattern '%s': %w", p, err)
+		}
+	}
+	slog.Debug("invoked the adopt command", "key", key, "certIDs", certIDs, "patterns", patterns, "forget", forget)
+
+	dir, err := stateSubdir(cCtx, "")
+	if err != nil {
+		return err
+	}
+	statePath := filepath.Join(dir, adoptionStateFile)
+	state, err := loadAdoptionState(statePath)
+	if err != nil {
+		return err
+	}
+
+	cfg := getConfig(cCtx.Context)
+	if forget {
+		changed, err := forgetAdoptions(cfg, state, key, certIDs, patterns)
+		if err != nil {
+			return err
+		}
+		if changed == 0 {
+			slog.Info("nothing changed")
+			return nil
+		}
+		return state.save(statePath)
+	}
+
+	foundIDs := make(map[string]struct{})
+	changed := 0
+	for _, acc := range cfg.Accounts {
+		for c, err := range qcdn.AllCerts(acc.qiniuCreds, 0) {
+			if err != nil {
+				slog.Error("failed to list certs", "account", acc.DisplayName, "err", err)
+				return err
+			}
+			if !slices.Contains(certIDs, c.ID) && !certMatchesAnyPattern(c, patterns) {
+				continue
+			}
+			foundIDs[c.ID] = struct{}{}
+
+			k := adoptionKey(acc, c.ID)
+			if n, ok := acc.certNames.parse(c.Name); ok {
+				slog.Warn("skipping already managed cert", "account", acc.DisplayName, "certID", c.ID, "key", n.Key)
+				continue
+			}
+			if a, ok := state.Adopted[k]; ok && a.Key != key {
+				slog.Warn(
+					"skipping cert adopted under another key",
+					"account", acc.DisplayName,
+					"certID", c.ID,
+					"key", a.Key,
+				)
+				continue
+			}
+
+			state.Adopted[k] = &adoptedCert{
+				Key:     key,
+				KeyType: fetchCertKeyType(acc, c.ID),
+				Name:    c.Name,
+				Time:    time.Now(),
+			}
+			fmt.Printf("%s: adopted %s (%s) as %s\n", acc.DisplayName, c.ID, c.Name, key)
+			changed++
+		}
+	}
+
+	for _, id := range certIDs {
+		if _, ok := foundIDs[id]; !ok {
+			return fmt.Errorf("cert %s not found in any of the selected accounts", id)
+		}
+	}
+	if changed == 0 {
+		slog.Info("nothing changed")
+		return nil
+	}
+	return state.save(statePath)
+}
+
+// forgetAdoptions removes the adoptions under the tracing key selected by
+// certIDs or patterns, or all of them if neither is given, returning the
+// number removed. The state is consulted directly so that adoptions of certs
+// deleted since can be forgotten as well; only matching by patterns needs
+// the certs to still exist.
+func forgetAdoptions(
+	cfg *Config,
+	state *adoptionState,
+	key string,
+	certIDs []string,
+	patterns []string,
+) (int, error) {
+	foundIDs := make(map[string]struct{})
+	changed := 0
+	for _, acc := range cfg.Accounts {
+		matchedIDs := make(map[string]struct{})
+		if len(patterns) > 0 {
+			for c, err := range qcdn.AllCerts(acc.qiniuCreds, 0) {
+				if err != nil {
+					slog.Error("failed to list certs", "account", acc.DisplayName, "err", err)
+					return 0, err
+				}
+				if certMatchesAnyPattern(c, patterns) {
+					matchedIDs[c.ID] = struct{}{}
+				}
+			}
+		}
+
+		for _, k := range slices.Sorted(maps.Keys(state.Adopted)) {
+			a := state.Adopted[k]
+			ak, certID, _ := strings.Cut(k, "/")
+			if ak != acc.AK || a.Key != key {
+				continue
+			}
+			if len(certIDs) > 0 || len(patterns) > 0 {
+				_, matched := matchedIDs[certID]
+				if !matched && !slices.Contains(certIDs, certID) {
+					continue
+				}
+			}
+			foundIDs[certID] = struct{}{}
+
+			delete(state.Adopted, k)
+			fmt.Printf("%s: forgot adoption of %s (%s) as %s\n", acc.DisplayName, certID, a.Name, key)
+			changed++
+		}
+	}
+
+	for _, id := range certIDs {
+		if _, ok := foundIDs[id]; !ok {
+			return 0, fmt.Errorf("cert %s not adopted as %s in any of the selected accounts", id, key)
+		}
+	}
+	return changed, nil
+}
+
+// certMatchesAnyPattern returns whether the CN or any SAN of the cert matches
+// any of the glob patterns.
+func certMatchesAnyPattern(c *qcdn.Cert, patterns []string) bool {
+	names := append([]string{c.CommonName}, c.DNSNames...)
+	for _, p := range patterns {
+		for _, n := range names {
+			if ok, _ := path.Match(p, n); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fetchCertKeyType learns the key type of the cert from its chain, returning
+// the empty value if that fails.
+func fetchCertKeyType(acc *AccountConfig, certID string) certKeyType {
+	c, err := qcdn.GetCert(acc.qiniuCreds, certID)
+	if err != nil {
+		slog.Warn("cannot fetch cert to learn its key type", "account", acc.DisplayName, "certID", certID, "err", err)
+		return ""
+	}
+	leaf, err := getLeafCert([]byte(c.CA))
+	if err != nil {
+		slog.Warn("cannot parse cert to learn its key type", "account", acc.DisplayName, "certID", certID, "err", err)
+		return ""
+	}
+	kt, err := keyTypeOfPublicKey(leaf.PublicKey)
+	if err != nil {
+		return ""
+	}
+	return kt
+}
@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+func cmdAuditVerify(cCtx *cli.Context) error {
+	path := cCtx.Args().First()
+	if len(path) == 0 {
+		// no secrets are needed for this, so don't bother resolving them
+		lc, err := loadConfigLayers(cCtx)
+		if err != nil {
+			return err
+		}
+		if lc.cfg.Audit == nil || len(lc.cfg.Audit.File) == 0 {
+			return errors.New("no audit log file configured or given")
+		}
+		path = lc.cfg.Audit.File
+	}
+
+	n, err := verifyAuditLog(path)
+	if err != nil {
+		fmt.Printf("%d record(s) verified before the first problem\n", n)
+		return err
+	}
+
+	fmt.Printf("%s: %d record(s), chain intact\n", path, n)
+	return nil
+}
@@ -0,0 +1,273 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+func cmdConfigCheck(cCtx *cli.Context) error {
+	verify := cCtx.Bool("verify")
+
+	var diags []diagnostic
+	files := make(map[string]configLocator)
+	var order []string
+	allParsed := true
+	if !isEnvOnlyConfig(cCtx) {
+		// the explicitly given file is checked even if missing
+		explicitPath := cCtx.Path("config")
+		for _, path := range configLayerPaths(explicitPath) {
+			if _, err := os.Stat(path); err != nil && path != explicitPath {
+				continue
+			}
+
+			slog.Debug("checking configuration file", "path", path)
+			_, loc, fileDiags := checkConfigFile(path)
+			diags = append(diags, fileDiags...)
+			if loc == nil {
+				allParsed = false
+				continue
+			}
+			files[path] = loc
+			order = append(order, path)
+		}
+	}
+
+	// only go on with the merged config if every file could be parsed, which
+	// is still the case with unknown keys
+	if allParsed {
+		lc, err := loadConfigLayers(cCtx)
+		if err != nil {
+			diags = append(diags, diagnostic{"merged configuration", sevError, err.Error()})
+		} else {
+			loc := layeredLocator{lc: lc, files: files, order: order}
+			diags = append(diags, unknownEnvKeys(len(lc.cfg.Accounts))...)
+			diags = append(diags, checkAccounts(lc.cfg.Accounts, &loc, verify)...)
+			diags = append(diags, checkNotifications(lc)...)
+		}
+	}
+
+	numErrors := 0
+	for _, d := range diags {
+		fmt.Println(d)
+		if d.severity == sevError {
+			numErrors++
+		}
+	}
+	fmt.Printf("%d error(s), %d warning(s)\n", numErrors, len(diags)-numErrors)
+
+	if numErrors > 0 {
+		return errors.New("configuration check failed")
+	}
+	return nil
+}
+
+func cmdConfigSchema(cCtx *cli.Context) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(configJSONSchema())
+}
+
+func cmdConfigShow(cCtx *cli.Context) error {
+	if !cCtx.Bool("effective") {
+		return showConfigLayers(cCtx)
+	}
+
+	lc, err := loadConfigLayers(cCtx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	printEffectiveFields(w, reflect.ValueOf(&lc.cfg).Elem(), reflect.Value{}, "", lc.sources)
+
+	for i, raw := range lc.cfg.Accounts {
+		// learn about the defaults without resolving any secret reference,
+		// which may run commands or query vaults just for display
+		finished := AccountConfig{
+			AK:                    raw.AK,
+			DisplayName:           raw.DisplayName,
+			ManagedCertNamePrefix: raw.ManagedCertNamePrefix,
+			CertNameTemplate:      raw.CertNameTemplate,
+		}
+		finished.applyDefaults()
+		if isSecretRef(raw.AK) && len(raw.DisplayName) == 0 {
+			// derived from the AK, thus unknown until it's resolved
+			finished.DisplayName = ""
+		}
+
+		fmt.Fprintln(w, "\n[[accounts]]")
+		printEffectiveFields(
+			w,
+			reflect.ValueOf(raw).Elem(),
+			reflect.ValueOf(&finished).Elem(),
+			fmt.Sprintf("accounts[%d]", i),
+			lc.sources,
+		)
+	}
+
+	return w.Flush()
+}
+
+// printEffectiveFields prints the non-zero config fields of v, except for the
+// accounts, along with their sources. Zero fields are taken from the
+// corresponding field of finished instead, if valid, as they are defaults.
+func printEffectiveFields(
+	w io.Writer,
+	v reflect.Value,
+	finished reflect.Value,
+	prefix string,
+	sources map[string]string,
+) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key, ok := configFieldName(t.Field(i))
+		if !ok || key == "accounts" {
+			continue
+		}
+
+		val := v.Field(i)
+		source := sources[joinConfigPath(prefix, key)]
+		if val.IsZero() {
+			if !finished.IsValid() || finished.Field(i).IsZero() {
+				continue
+			}
+			val = finished.Field(i)
+			source = sourceDefault
+		}
+
+		var repr bytes.Buffer
+		enc := json.NewEncoder(&repr)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(redactConfigValue(val, t.Field(i).Tag.Get("redact")).Interface())
+
+		fmt.Fprintf(w, "%s = %s\t# %s\n", key, bytes.TrimSuffix(repr.Bytes(), []byte("\n")), source)
+	}
+}
+
+const redactedConfigValue = "<redacted>"
+
+// redaction modes, as given by the redact tag of config fields
+const (
+	// the whole value, or every value of a map, is secret
+	redactAll = "true"
+	// only the host of the URL is shown, as chat bots carry the token in the
+	// query string (WeCom, DingTalk) or the path (Feishu, Slack)
+	redactURL = "url"
+)
+
+// redactConfigValue returns a copy of v for display, with the fields tagged
+// `redact` masked. Secret references are kept as they reveal nothing.
+func redactConfigValue(v reflect.Value, mode string) reflect.Value {
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		if len(mode) == 0 || len(s) == 0 || isSecretRef(s) {
+			return v
+		}
+		r := reflect.New(v.Type()).Elem()
+		if mode == redactURL {
+			r.SetString(redactURLSecrets(s))
+		} else {
+			r.SetString(redactedConfigValue)
+		}
+		return r
+
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		r := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			r.SetMapIndex(iter.Key(), redactConfigValue(iter.Value(), mode))
+		}
+		return r
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		r := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			r.Index(i).Set(redactConfigValue(v.Index(i), mode))
+		}
+		return r
+
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		r := reflect.New(v.Type().Elem())
+		r.Elem().Set(redactConfigValue(v.Elem(), mode))
+		return r
+
+	case reflect.Struct:
+		r := reflect.New(v.Type()).Elem()
+		r.Set(v)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			r.Field(i).Set(redactConfigValue(v.Field(i), f.Tag.Get("redact")))
+		}
+		return r
+
+	default:
+		return v
+	}
+}
+
+// redactURLSecrets keeps only the scheme and host of the URL.
+func redactURLSecrets(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || len(u.Host) == 0 {
+		return redactedConfigValue
+	}
+	if u.User == nil && (len(u.Path) == 0 || u.Path == "/") && len(u.RawQuery) == 0 {
+		return s
+	}
+	return u.Scheme + "://" + u.Host + "/" + redactedConfigValue
+}
+
+func showConfigLayers(cCtx *cli.Context) error {
+	if isEnvOnlyConfig(cCtx) {
+		fmt.Printf("config files: (ignored because of --env-config or %s)\n", envNumAccounts)
+	} else {
+		fmt.Println("config files, in increasing order of precedence:")
+		for _, p := range configLayerPaths(cCtx.Path("config")) {
+			state := "not found"
+			if _, err := os.Stat(p); err == nil {
+				state = "found"
+			}
+			fmt.Printf("  %s (%s)\n", p, state)
+		}
+	}
+
+	var envKeys []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(k, "QCR_") {
+			envKeys = append(envKeys, k)
+		}
+	}
+	slices.Sort(envKeys)
+	fmt.Printf("environment overrides: %s\n", strings.Join(envKeys, " "))
+	fmt.Println("(use --effective to show the merged configuration)")
+	return nil
+}
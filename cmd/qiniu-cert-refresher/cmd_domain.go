@@ -0,0 +1,303 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/qiniu/go-sdk/v7/auth"
+	"github.com/samber/lo"
+	"github.com/urfave/cli/v2"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+// listedDomain is the JSON output format of the domain list command.
+type listedDomain struct {
+	Account string `json:"account"`
+	*qcdn.Domain
+}
+
+func cmdDomainList(cCtx *cli.Context) error {
+	cfg := getConfig(cCtx.Context)
+
+	format := cCtx.String("format")
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unsupported output format '%s'", format)
+	}
+
+	nameGlobs := cCtx.StringSlice("name")
+	for _, g := range nameGlobs {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("bad domain glob '%s': %w", g, err)
+		}
+	}
+	httpsOnly := cCtx.Bool("https-only")
+	tags := cCtx.StringSlice("tag")
+
+	types := lo.Map(cCtx.StringSlice("type"), func(t string, _ int) qcdn.DomainType {
+		return qcdn.DomainType(t)
+	})
+	req := qcdn.ReqListDomains{
+		Types:             types,
+		CertID:            cCtx.String("cert-id"),
+		SourceTypes:       cCtx.StringSlice("source-type"),
+		SourceQiniuBucket: cCtx.String("source-bucket"),
+		SourceIP:          cCtx.String("source-ip"),
+		Limit:             cCtx.Int("page-size"),
+	}
+	slog.Debug("invoked the domain list command", "req", req, "names", nameGlobs, "httpsOnly", httpsOnly, "tags", tags)
+
+	var result []listedDomain
+	for _, acc := range cfg.Accounts {
+		for d, err := range qcdn.AllDomains(acc.qiniuCreds, req) {
+			if err != nil {
+				slog.Error("failed to list domains", "account", acc.DisplayName, "err", err)
+				return err
+			}
+
+			if len(nameGlobs) > 0 && !lo.SomeBy(nameGlobs, func(g string) bool {
+				ok, _ := path.Match(g, d.Name)
+				return ok
+			}) {
+				continue
+			}
+			if httpsOnly && d.Protocol != "https" {
+				continue
+			}
+			if !lo.Every(d.TagList, tags) {
+				continue
+			}
+
+			result = append(result, listedDomain{Account: acc.DisplayName, Domain: d})
+		}
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tDOMAIN\tTYPE\tPROTOCOL\tSTATUS\tCNAME\tTAGS")
+	for _, x := range result {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			x.Account,
+			x.Name,
+			x.Type,
+			x.Protocol,
+			x.LastOpStatus,
+			x.CName,
+			strings.Join(x.TagList, ","),
+		)
+	}
+	return w.Flush()
+}
+
+func cmdDomainShow(cCtx *cli.Context) error {
+	acc, err := getSingleAccount(getConfig(cCtx.Context))
+	if err != nil {
+		return err
+	}
+
+	names := cCtx.Args().Slice()
+	if len(names) == 0 {
+		return errors.New("at least one domain must be given")
+	}
+	slog.Debug("invoked the domain show command", "account", acc.DisplayName, "domains", names)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	for _, name := range names {
+		d, err := qcdn.GetDomain(acc.qiniuCreds, name)
+		if err != nil {
+			slog.Error("failed to get domain", "account", acc.DisplayName, "domain", name, "err", err)
+			return err
+		}
+
+		if d.IsFrozen() {
+			slog.Warn("domain is frozen", "account", acc.DisplayName, "domain", name)
+		}
+
+		err = enc.Encode(d)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cmdDomainCreate(cCtx *cli.Context) error {
+	acc, err := getSingleAccount(getConfig(cCtx.Context))
+	if err != nil {
+		return err
+	}
+
+	name := cCtx.Args().First()
+	if len(name) == 0 {
+		return errors.New("the domain to create must be given")
+	}
+	slog.Debug("invoked the domain create command", "account", acc.DisplayName, "domain", name)
+
+	req, err := makeCreateDomainRequest(cCtx, acc, name)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("about to create domain", "account", acc.DisplayName, "domain", name, "req", req)
+	err = qcdn.CreateDomain(acc.qiniuCreds, name, req)
+	if err != nil {
+		slog.Error("failed to create domain", "account", acc.DisplayName, "domain", name, "err", err)
+		return err
+	}
+
+	d, err := qcdn.GetDomain(acc.qiniuCreds, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created %s, please CNAME it to %s\n", name, d.CName)
+	return nil
+}
+
+func makeCreateDomainRequest(cCtx *cli.Context, acc *AccountConfig, name string) (*qcdn.ReqCreateDomain, error) {
+	source := qcdn.SourceConfig{
+		SourceType:        qcdn.SourceType(cCtx.String("source-type")),
+		SourceHost:        cCtx.String("source-host"),
+		SourceIPs:         cCtx.StringSlice("source-ip"),
+		SourceDomain:      cCtx.String("source-domain"),
+		SourceQiniuBucket: cCtx.String("source-bucket"),
+		SourceURLScheme:   cCtx.String("source-scheme"),
+		TestURLPath:       cCtx.String("test-url-path"),
+	}
+	switch source.SourceType {
+	case qcdn.SourceTypeDomain:
+		if len(source.SourceDomain) == 0 {
+			return nil, errors.New("--source-domain is required for source type 'domain'")
+		}
+	case qcdn.SourceTypeIP:
+		if len(source.SourceIPs) == 0 {
+			return nil, errors.New("--source-ip is required for source type 'ip'")
+		}
+	case qcdn.SourceTypeQiniuBucket:
+		if len(source.SourceQiniuBucket) == 0 {
+			return nil, errors.New("--source-bucket is required for source type 'qiniuBucket'")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported source type '%s'", source.SourceType)
+	}
+
+	req := qcdn.ReqCreateDomain{
+		Type:         qcdn.DomainType(cCtx.String("type")),
+		Platform:     cCtx.String("platform"),
+		GeoCover:     cCtx.String("geo-cover"),
+		Protocol:     "http",
+		ParentDomain: cCtx.String("parent-domain"),
+		Source:       &source,
+	}
+	if cCtx.Bool("ipv6") {
+		req.IPTypes = qcdn.IPTypeV4V6
+	}
+
+	certID, err := resolveCertIDForNewDomain(acc, name, cCtx.String("cert-id"), cCtx.String("tracing-key"))
+	if err != nil {
+		return nil, err
+	}
+	if len(certID) > 0 {
+		req.Protocol = "https"
+		req.HTTPS = &qcdn.HTTPSConfig{
+			CertID:       certID,
+			ForceHTTPS:   cCtx.Bool("force-https"),
+			HTTP2Enabled: cCtx.Bool("http2"),
+		}
+	} else if cCtx.Bool("force-https") || cCtx.Bool("http2") {
+		return nil, errors.New("HTTPS options require either --cert-id or --tracing-key")
+	}
+
+	return &req, nil
+}
+
+// resolveCertIDForNewDomain returns the cert ID to use for the new domain,
+// picking the latest valid cert of the tracing key if one is given, of the
+// key type preferred for the domain if any.
+func resolveCertIDForNewDomain(acc *AccountConfig, domain string, certID string, key string) (string, error) {
+	if len(certID) > 0 && len(key) > 0 {
+		return "", errors.New("only one of --cert-id and --tracing-key can be given")
+	}
+	if len(key) == 0 {
+		return certID, nil
+	}
+
+	relevantCerts, err := listAllCertsWithTracingKey(acc, key)
+	if err != nil {
+		return "", err
+	}
+
+	keyType := acc.preferredKeyType(domain)
+	if len(keyType) > 0 {
+		relevantCerts = filterCertsByKeyType(acc, relevantCerts, keyType)
+	}
+
+	targetCert := findLatestNonExpiringValidCert(relevantCerts, time.Now())
+	if targetCert == nil {
+		if len(keyType) > 0 {
+			return "", fmt.Errorf("no valid %s certificate found for tracing key '%s'", keyType, key)
+		}
+		return "", fmt.Errorf("no valid certificate found for tracing key '%s'", key)
+	}
+
+	return targetCert.ID, nil
+}
+
+func cmdDomainOnline(cCtx *cli.Context) error {
+	return forEachDomainArg(cCtx, "online", qcdn.OnlineDomain)
+}
+
+func cmdDomainOffline(cCtx *cli.Context) error {
+	return forEachDomainArg(cCtx, "offline", qcdn.OfflineDomain)
+}
+
+func cmdDomainDelete(cCtx *cli.Context) error {
+	return forEachDomainArg(cCtx, "delete", qcdn.DeleteDomain)
+}
+
+func forEachDomainArg(
+	cCtx *cli.Context,
+	opName string,
+	op func(*auth.Credentials, string) error,
+) error {
+	acc, err := getSingleAccount(getConfig(cCtx.Context))
+	if err != nil {
+		return err
+	}
+
+	names := cCtx.Args().Slice()
+	if len(names) == 0 {
+		return errors.New("at least one domain must be given")
+	}
+	slog.Debug("invoked a domain command", "op", opName, "account", acc.DisplayName, "domains", names)
+
+	for _, name := range names {
+		slog.Debug("about to operate on domain", "op", opName, "account", acc.DisplayName, "domain", name)
+		err := op(acc.qiniuCreds, name)
+		if err != nil {
+			slog.Error("domain operation failed", "op", opName, "account", acc.DisplayName, "domain", name, "err", err)
+			return err
+		}
+		fmt.Printf("%s: %s done\n", name, opName)
+	}
+
+	return nil
+}
@@ -5,6 +5,8 @@ package main
 import (
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/urfave/cli/v2"
@@ -56,6 +58,12 @@ func showAccount(acc *AccountConfig) error {
 	fmt.Printf("# Account %s\n", acc.DisplayName)
 	for _, cert := range allCerts {
 		fmt.Printf("\n- ID:         %s\n  Name:       %s\n  CommonName: %s\n", cert.ID, cert.Name, cert.CommonName)
+		if key, kt, ok := acc.tracingKeyOfCert(cert); ok {
+			if _, adopted := acc.adopted[cert.ID]; adopted {
+				key += " (adopted)"
+			}
+			fmt.Printf("  TracingKey: %s\n  KeyType:    %s\n", key, kt)
+		}
 		fmt.Printf("  NotBefore:  %s\n", time.Unix(cert.NotBefore, 0).Format(time.RFC3339))
 		fmt.Printf("  NotAfter:   %s\n", time.Unix(cert.NotAfter, 0).Format(time.RFC3339))
 		fmt.Printf("  CreatedAt:  %s\n", time.Unix(cert.CreateTime, 0).Format(time.RFC3339))
@@ -80,5 +88,87 @@ func showAccount(acc *AccountConfig) error {
 		}
 	}
 
+	showTracingKeys(acc, allCerts)
+	return showTracingKeyDrifts(acc, allCerts, domainsByCertID)
+}
+
+// showTracingKeys lists the certs currently in effect for each tracing key,
+// one per key type.
+func showTracingKeys(acc *AccountConfig, allCerts []*qcdn.Cert) {
+	certsByKey := make(map[string][]*qcdn.Cert)
+	for _, cert := range allCerts {
+		if key, _, ok := acc.tracingKeyOfCert(cert); ok {
+			certsByKey[key] = append(certsByKey[key], cert)
+		}
+	}
+	if len(certsByKey) == 0 {
+		return
+	}
+
+	now := time.Now()
+	fmt.Println("\n## Tracing keys")
+	for _, key := range slices.Sorted(maps.Keys(certsByKey)) {
+		fmt.Printf("\n- %s:\n", key)
+		for _, kt := range append(slices.Clone(certKeyTypes), "") {
+			certs := filterCertsByKeyType(acc, certsByKey[key], kt)
+			if len(certs) == 0 {
+				continue
+			}
+
+			latest := findLatestNonExpiringValidCert(certs, now)
+			if latest == nil {
+				fmt.Printf("    %-10s (no valid cert)\n", kt.String()+":")
+				continue
+			}
+			fmt.Printf(
+				"    %-10s %s, expires %s\n",
+				kt.String()+":",
+				latest.ID,
+				time.Unix(latest.NotAfter, 0).Format(time.RFC3339),
+			)
+		}
+	}
+}
+
+// showTracingKeyDrifts compares the domains declared for the tracing keys with
+// the actual bindings, given the domains of each cert.
+func showTracingKeyDrifts(
+	acc *AccountConfig,
+	allCerts []*qcdn.Cert,
+	domainsByCertID map[string][]*qcdn.Domain,
+) error {
+	if len(acc.TracingKeys) == 0 {
+		return nil
+	}
+
+	slog.Debug("querying domains", "account", acc.DisplayName)
+	allDomains, err := qcdn.ListAllDomains(acc.qiniuCreds)
+	if err != nil {
+		slog.Error("failed to list domains", "account", acc.DisplayName, "err", err)
+		return err
+	}
+
+	bindings := domainBindings(domainsByCertID)
+	fmt.Println("\n## Drift from declared domains")
+	for _, tk := range acc.TracingKeys {
+		keyCertIDs := make(map[string]struct{})
+		for _, cert := range allCerts {
+			if key, _, ok := acc.tracingKeyOfCert(cert); ok && key == tk.Key {
+				keyCertIDs[cert.ID] = struct{}{}
+			}
+		}
+
+		drifts := findTracingKeyDrifts(tk, allDomains, bindings, keyCertIDs)
+		if len(drifts) == 0 {
+			fmt.Printf("\n- %s: no drift\n", tk.Key)
+			continue
+		}
+
+		fmt.Printf("\n- %s:\n", tk.Key)
+		for _, d := range drifts {
+			fmt.Printf("    - %s: %s\n", d.Domain, d.String())
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,337 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+const inventoryFetchConcurrency = 8
+
+// inventory flags
+const (
+	inventoryFlagDuplicate    = "duplicate"
+	inventoryFlagUnused       = "unused"
+	inventoryFlagExpired      = "expired"
+	inventoryFlagExpiredBound = "expired-bound"
+)
+
+// inventory is the output of the inventory command.
+type inventory struct {
+	Time     time.Time           `json:"time"`
+	Certs    []*inventoryCert    `json:"certs"`
+	Accounts []*inventoryAccount `json:"accounts"`
+}
+
+type inventoryCert struct {
+	Account    string    `json:"account"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	CommonName string    `json:"commonName"`
+	DNSNames   []string  `json:"dnsNames"`
+	NotBefore  time.Time `json:"notBefore"`
+	NotAfter   time.Time `json:"notAfter"`
+	// Fingerprint is the SHA-256 of the leaf cert, empty if the chain is not
+	// available
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Group numbers the distinct certs, so copies share the same number
+	Group      int      `json:"group"`
+	TracingKey string   `json:"tracingKey,omitempty"`
+	KeyType    string   `json:"keyType,omitempty"`
+	Domains    []string `json:"domains"`
+	Flags      []string `json:"flags"`
+
+	// groupKey identifies the cert across accounts
+	groupKey string
+}
+
+type inventoryAccount struct {
+	Name     string `json:"name"`
+	NumCerts int    `json:"numCerts"`
+	// Quota is as given on the command line, 0 if unknown
+	Quota     int  `json:"quota,omitempty"`
+	NearQuota bool `json:"nearQuota"`
+}
+
+func cmdInventory(cCtx *cli.Context) error {
+	format := cCtx.String("format")
+	if format != "table" && format != "csv" && format != "json" {
+		return fmt.Errorf("unsupported output format '%s'", format)
+	}
+	quota := cCtx.Int("cert-quota")
+	quotaWarning := cCtx.Float64("quota-warning")
+	fetchCerts := cCtx.Bool("fetch-certs")
+	slog.Debug("invoked the inventory command", "format", format, "quota", quota, "fetchCerts", fetchCerts)
+
+	cfg := getConfig(cCtx.Context)
+	inv := inventory{Time: time.Now()}
+	for _, acc := range cfg.Accounts {
+		certs, err := collectInventoryCerts(acc, fetchCerts, inv.Time)
+		if err != nil {
+			slog.Error("failed to collect certs", "account", acc.DisplayName, "err", err)
+			return err
+		}
+		inv.Certs = append(inv.Certs, certs...)
+
+		a := inventoryAccount{Name: acc.DisplayName, NumCerts: len(certs), Quota: quota}
+		if quota > 0 && float64(len(certs)) >= quotaWarning*float64(quota) {
+			a.NearQuota = true
+			slog.Warn(
+				"account is near its cert quota",
+				"account", acc.DisplayName,
+				"numCerts", len(certs),
+				"quota", quota,
+			)
+		}
+		inv.Accounts = append(inv.Accounts, &a)
+	}
+	groupInventoryCerts(inv.Certs)
+
+	w := io.Writer(os.Stdout)
+	if out := cCtx.Path("output"); len(out) > 0 {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(&inv)
+	case "csv":
+		return writeInventoryCSV(w, &inv)
+	default:
+		return writeInventoryTable(w, &inv)
+	}
+}
+
+// collectInventoryCerts lists the certs of the account along with the
+// domains using them.
+func collectInventoryCerts(acc *AccountConfig, fetchCerts bool, now time.Time) ([]*inventoryCert, error) {
+	certs, err := qcdn.ListAllCerts(acc.qiniuCreds)
+	if err != nil {
+		return nil, err
+	}
+
+	// the domain listing doesn't return the HTTPS configs, so list the
+	// domains of every cert instead
+	certDomains := make([][]string, len(certs))
+	var eg errgroup.Group
+	eg.SetLimit(inventoryFetchConcurrency)
+	for i, c := range certs {
+		eg.Go(func() error {
+			domains, err := qcdn.ListAllDomainsByCertID(acc.qiniuCreds, c.ID)
+			if err != nil {
+				return err
+			}
+			certDomains[i] = lo.Map(domains, func(d *qcdn.Domain, _ int) string { return d.Name })
+			return nil
+		})
+	}
+	err = eg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	if fetchCerts {
+		// the chains are not necessarily part of the listing
+		var fetchGroup errgroup.Group
+		fetchGroup.SetLimit(inventoryFetchConcurrency)
+		for _, c := range certs {
+			if len(c.CA) > 0 {
+				continue
+			}
+			fetchGroup.Go(func() error {
+				details, err := qcdn.GetCert(acc.qiniuCreds, c.ID)
+				if err != nil {
+					return err
+				}
+				// the private key comes along as well, but is masked in HTTP
+				// traces and dropped right away
+				c.CA = details.CA
+				return nil
+			})
+		}
+		err = fetchGroup.Wait()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]*inventoryCert, 0, len(certs))
+	for i, c := range certs {
+		ic := inventoryCert{
+			Account:    acc.DisplayName,
+			ID:         c.ID,
+			Name:       c.Name,
+			CommonName: c.CommonName,
+			DNSNames:   c.DNSNames,
+			NotBefore:  time.Unix(c.NotBefore, 0),
+			NotAfter:   time.Unix(c.NotAfter, 0),
+			Domains:    certDomains[i],
+			Flags:      []string{},
+		}
+		if key, kt, ok := acc.tracingKeyOfCert(c); ok {
+			ic.TracingKey = key
+			ic.KeyType = string(kt)
+		}
+		if leaf, err := getLeafCert([]byte(c.CA)); err == nil {
+			fp := sha256.Sum256(leaf.Raw)
+			ic.Fingerprint = hex.EncodeToString(fp[:])
+		}
+		ic.groupKey = inventoryGroupKey(&ic)
+
+		if len(ic.Domains) == 0 {
+			ic.Domains = []string{}
+			ic.Flags = append(ic.Flags, inventoryFlagUnused)
+		}
+		if ic.NotAfter.Before(now) {
+			ic.Flags = append(ic.Flags, inventoryFlagExpired)
+			if len(ic.Domains) > 0 {
+				ic.Flags = append(ic.Flags, inventoryFlagExpiredBound)
+			}
+		}
+
+		result = append(result, &ic)
+	}
+
+	return result, nil
+}
+
+// inventoryGroupKey identifies the cert by its fingerprint if known, or else
+// by its names and validity period, which are unlikely to coincide for
+// different certs.
+func inventoryGroupKey(c *inventoryCert) string {
+	if len(c.Fingerprint) > 0 {
+		return c.Fingerprint
+	}
+
+	names := append([]string{c.CommonName}, c.DNSNames...)
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	var sb strings.Builder
+	sb.WriteString(strings.Join(names, ","))
+	sb.WriteRune('|')
+	sb.WriteString(strconv.FormatInt(c.NotBefore.Unix(), 10))
+	sb.WriteRune('|')
+	sb.WriteString(strconv.FormatInt(c.NotAfter.Unix(), 10))
+	return sb.String()
+}
+
+// groupInventoryCerts numbers the distinct certs in order of appearance, and
+// flags the copies.
+func groupInventoryCerts(certs []*inventoryCert) {
+	groups := make(map[string]int)
+	sizes := make(map[string]int)
+	for _, c := range certs {
+		if _, ok := groups[c.groupKey]; !ok {
+			groups[c.groupKey] = len(groups) + 1
+		}
+		sizes[c.groupKey]++
+	}
+
+	for _, c := range certs {
+		c.Group = groups[c.groupKey]
+		if sizes[c.groupKey] > 1 {
+			c.Flags = append(c.Flags, inventoryFlagDuplicate)
+		}
+	}
+}
+
+func writeInventoryCSV(w io.Writer, inv *inventory) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{
+		"account",
+		"cert_id",
+		"name",
+		"common_name",
+		"dns_names",
+		"not_before",
+		"not_after",
+		"fingerprint",
+		"group",
+		"tracing_key",
+		"key_type",
+		"domains",
+		"flags",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range inv.Certs {
+		err := cw.Write([]string{
+			c.Account,
+			c.ID,
+			c.Name,
+			c.CommonName,
+			strings.Join(c.DNSNames, ";"),
+			c.NotBefore.Format(time.RFC3339),
+			c.NotAfter.Format(time.RFC3339),
+			c.Fingerprint,
+			strconv.Itoa(c.Group),
+			c.TracingKey,
+			c.KeyType,
+			strings.Join(c.Domains, ";"),
+			strings.Join(c.Flags, ";"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeInventoryTable(w io.Writer, inv *inventory) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tCERT ID\tCOMMON NAME\tNOT AFTER\tGROUP\tDOMAINS\tFLAGS")
+	for _, c := range inv.Certs {
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			c.Account,
+			c.ID,
+			c.CommonName,
+			c.NotAfter.Format(time.DateOnly),
+			c.Group,
+			len(c.Domains),
+			strings.Join(c.Flags, ","),
+		)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, a := range inv.Accounts {
+		if a.NearQuota {
+			fmt.Fprintf(w, "\naccount %s is near its cert quota: %d of %d\n", a.Name, a.NumCerts, a.Quota)
+		}
+	}
+	return nil
+}
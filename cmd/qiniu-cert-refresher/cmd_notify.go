@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// cmdNotifyTest sends a made-up rotation notification with the configured
+// channels, so they can be tried out without rotating anything.
+func cmdNotifyTest(cCtx *cli.Context) error {
+	cfg := getConfig(cCtx.Context)
+	if len(cfg.Notifications) == 0 {
+		return errors.New("no notification channel configured")
+	}
+
+	names := cCtx.StringSlice("channel")
+	success := !cCtx.Bool("failure")
+	notice := sampleRotationNotice(success)
+
+	numFailed := 0
+	numSent := 0
+	for _, nc := range cfg.Notifications {
+		if len(names) > 0 && !slices.Contains(names, nc.String()) {
+			continue
+		}
+
+		numSent++
+		err := sendNotification(cCtx.Context, nc, notificationKindRotation, success, notice)
+		if err != nil {
+			fmt.Printf("%s: FAILED: %s\n", nc, err)
+			numFailed++
+			continue
+		}
+		fmt.Printf("%s: ok\n", nc)
+	}
+
+	if numSent == 0 {
+		return errors.New("no notification channel matched")
+	}
+	if numFailed > 0 {
+		return fmt.Errorf("%d of %d channel(s) failed", numFailed, numSent)
+	}
+	return nil
+}
+
+func sampleRotationNotice(success bool) *rotationNotice {
+	domain := &rotationNoticeDomain{Name: "www.example.com", Result: "ok"}
+	acc := &rotationNoticeAccount{
+		Name:    "example",
+		CertID:  "0123456789abcdef01234567",
+		Domains: []*rotationNoticeDomain{domain},
+	}
+	if !success {
+		domain.Failed = true
+		domain.Result = "FAILED: this is a test"
+		acc.Failed = true
+	}
+
+	return &rotationNotice{
+		TracingKey: "test",
+		Success:    success,
+		Host:       hostnameOrUnknown(),
+		Time:       time.Now(),
+		Expiry:     time.Now().AddDate(0, 0, 90),
+		Accounts:   []*rotationNoticeAccount{acc},
+	}
+}
@@ -0,0 +1,265 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+const notificationKindExpiring notificationKind = "expiring"
+
+// expiringNotice is what expiry warnings are rendered from.
+type expiringNotice struct {
+	Days     int                      `json:"days"`
+	Host     string                   `json:"host"`
+	Time     time.Time                `json:"time"`
+	Accounts []*expiringNoticeAccount `json:"accounts"`
+}
+
+type expiringNoticeAccount struct {
+	Name  string                `json:"name"`
+	Certs []*expiringNoticeCert `json:"certs"`
+}
+
+type expiringNoticeCert struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	CommonName string    `json:"commonName"`
+	Expiry     time.Time `json:"expiry"`
+	Expired    bool      `json:"expired"`
+	DaysLeft   int       `json:"daysLeft"`
+	Domains    []string  `json:"domains"`
+}
+
+func init() {
+	registerDefaultNotificationTemplate(notificationKindExpiring, &NotificationTemplate{
+		Subject: `[qcr] certs expiring within {{.Days}} days`,
+		Body: `Certs bound to live domains that expire within {{.Days}} days, as seen from {{.Host}}:
+{{range .Accounts}}
+Account {{.Name}}:
+{{- range .Certs}}
+  - {{.Name}} ({{.ID}}, {{.CommonName}}):
+    {{- if .Expired}} EXPIRED{{else}} {{.DaysLeft}} day(s) left{{end -}}
+    , at {{.Expiry.Format "2006-01-02 15:04:05 MST"}}
+{{- range .Domains}}
+    - {{.}}
+{{- end}}
+{{- end}}
+{{end}}`,
+	})
+}
+
+// expiryWarningState remembers which certs were warned about when, so the
+// same warning isn't repeated on every run.
+type expiryWarningState struct {
+	// Warned is keyed by "<AK>/<cert ID>"
+	Warned map[string]time.Time `json:"warned"`
+}
+
+func loadExpiryWarningState(path string) (*expiryWarningState, error) {
+	result := expiryWarningState{Warned: make(map[string]time.Time)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &result, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if result.Warned == nil {
+		result.Warned = make(map[string]time.Time)
+	}
+	return &result, nil
+}
+
+func (s *expiryWarningState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+func expiryWarningKey(acc *AccountConfig, certID string) string {
+	return acc.AK + "/" + certID
+}
+
+func cmdNotifyExpiring(cCtx *cli.Context) error {
+	days := cCtx.Int("days")
+	repeatAfter := cCtx.Duration("repeat-after")
+	dryRun := cCtx.Bool("dry-run")
+
+	cfg := getConfig(cCtx.Context)
+	if len(cfg.Notifications) == 0 && !dryRun {
+		return errors.New("no notification channel configured")
+	}
+
+	stateDir, err := stateSubdir(cCtx, "notify")
+	if err != nil {
+		return err
+	}
+	statePath := filepath.Join(stateDir, "expiring.json")
+	state, err := loadExpiryWarningState(statePath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	notice := expiringNotice{
+		Days: days,
+		Host: hostnameOrUnknown(),
+		Time: now,
+	}
+	stillExpiring := make(map[string]struct{})
+	scannedAKs := make(map[string]struct{})
+	var toMark []string
+	numFailedAccounts := 0
+	for _, acc := range cfg.Accounts {
+		certs, err := findExpiringLiveCerts(acc, now, days)
+		if err != nil {
+			// carry on, so one account's outage doesn't hide the others'
+			// expiring certs
+			slog.Error("failed to scan account", "account", acc.DisplayName, "err", err)
+			numFailedAccounts++
+			continue
+		}
+		scannedAKs[acc.AK] = struct{}{}
+
+		var due []*expiringNoticeCert
+		for _, c := range certs {
+			key := expiryWarningKey(acc, c.ID)
+			stillExpiring[key] = struct{}{}
+
+			if last, ok := state.Warned[key]; ok && now.Sub(last) < repeatAfter {
+				slog.Debug("already warned recently", "account", acc.DisplayName, "certID", c.ID, "at", last)
+				continue
+			}
+			due = append(due, c)
+			toMark = append(toMark, key)
+		}
+
+		if len(due) > 0 {
+			notice.Accounts = append(notice.Accounts, &expiringNoticeAccount{
+				Name:  acc.DisplayName,
+				Certs: due,
+			})
+		}
+	}
+
+	// forget certs no longer expiring soon (likely rotated), so they are
+	// warned about afresh if it ever happens again; accounts not selected
+	// this time or failed to scan are left alone
+	for key := range state.Warned {
+		ak, _, _ := strings.Cut(key, "/")
+		if _, ok := scannedAKs[ak]; !ok {
+			continue
+		}
+		if _, ok := stillExpiring[key]; !ok {
+			delete(state.Warned, key)
+		}
+	}
+
+	var accountsErr error
+	if numFailedAccounts > 0 {
+		accountsErr = fmt.Errorf("failed to scan %d of %d account(s)", numFailedAccounts, len(cfg.Accounts))
+	}
+
+	if len(notice.Accounts) == 0 {
+		slog.Info("nothing to warn about", "days", days)
+		if dryRun {
+			return accountsErr
+		}
+		return errors.Join(state.save(statePath), accountsErr)
+	}
+
+	if dryRun {
+		data, err := json.MarshalIndent(&notice, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return accountsErr
+	}
+
+	numFailed := sendNotifications(cCtx.Context, cfg, notificationKindExpiring, false, &notice)
+	if numFailed == len(cfg.Notifications) {
+		// keep the state, so the warning is retried next time
+		return errors.Join(errors.New("failed to send the expiry warning with any channel"), accountsErr)
+	}
+
+	for _, key := range toMark {
+		state.Warned[key] = now
+	}
+	err = state.save(statePath)
+	if err != nil {
+		return err
+	}
+
+	if numFailed > 0 {
+		return errors.Join(fmt.Errorf("%d of %d channel(s) failed", numFailed, len(cfg.Notifications)), accountsErr)
+	}
+	return accountsErr
+}
+
+// findExpiringLiveCerts returns the certs of the account that expire within
+// the given number of days from now and are used by at least one live
+// domain.
+func findExpiringLiveCerts(acc *AccountConfig, now time.Time, days int) ([]*expiringNoticeCert, error) {
+	deadline := now.AddDate(0, 0, days).Unix()
+
+	var result []*expiringNoticeCert
+	for c, err := range qcdn.AllCerts(acc.qiniuCreds, 0) {
+		if err != nil {
+			return nil, err
+		}
+		if c.NotAfter > deadline {
+			continue
+		}
+
+		domains, err := qcdn.ListAllDomainsByCertID(acc.qiniuCreds, c.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		var live []string
+		for _, d := range domains {
+			if d.IsOffline() || d.IsFrozen() {
+				continue
+			}
+			live = append(live, d.Name)
+		}
+		if len(live) == 0 {
+			continue
+		}
+
+		expiry := time.Unix(c.NotAfter, 0)
+		result = append(result, &expiringNoticeCert{
+			ID:         c.ID,
+			Name:       c.Name,
+			CommonName: c.CommonName,
+			Expiry:     expiry,
+			Expired:    expiry.Before(now),
+			DaysLeft:   int(expiry.Sub(now).Hours()) / 24,
+			Domains:    live,
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+const reconcileConcurrency = 8
+
+func cmdReconcile(cCtx *cli.Context) error {
+	cfg := getConfig(cCtx.Context)
+	apply := cCtx.Bool("apply")
+	slog.Debug("invoked the reconcile command", "apply", apply)
+
+	var failed bool
+	for _, acc := range cfg.Accounts {
+		if len(acc.HTTPSPolicies) == 0 {
+			slog.Debug("no HTTPS policy for account, skipping", "account", acc.DisplayName)
+			continue
+		}
+
+		err := reconcileAccount(acc, apply)
+		if err != nil {
+			slog.Error("failed to reconcile account", "account", acc.DisplayName, "err", err)
+			failed = true
+		}
+	}
+
+	if failed {
+		return errors.New("reconciliation failed for some accounts")
+	}
+	return nil
+}
+
+// domainPlan is the pending correction of one domain's HTTPS config.
+type domainPlan struct {
+	domain  string
+	current *qcdn.HTTPSConfig
+	desired *qcdn.HTTPSConfig
+	drifts  []httpsDrift
+	skipMsg string
+}
+
+func reconcileAccount(acc *AccountConfig, apply bool) error {
+	plans, err := planReconciliation(acc)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("# Account %s\n", acc.DisplayName)
+	if len(plans) == 0 {
+		fmt.Println("no drift detected")
+		return nil
+	}
+
+	var failed bool
+	for _, p := range plans {
+		if len(p.skipMsg) > 0 {
+			fmt.Printf("  %s: skipped: %s\n", p.domain, p.skipMsg)
+			continue
+		}
+
+		drifts := make([]string, len(p.drifts))
+		for i, d := range p.drifts {
+			drifts[i] = d.String()
+		}
+		fmt.Printf("  %s: %s\n", p.domain, strings.Join(drifts, ", "))
+
+		if !apply {
+			continue
+		}
+
+		slog.Debug("about to update HTTPS config", "account", acc.DisplayName, "domain", p.domain, "cfg", p.desired)
+		err := qcdn.UpdateHTTPSConfigAudited(acc.qiniuCreds, p.domain, p.current, p.desired)
+		if err != nil {
+			slog.Error("failed to correct HTTPS config", "account", acc.DisplayName, "domain", p.domain, "err", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("  %s: corrected\n", p.domain)
+	}
+
+	if !apply {
+		fmt.Println("(plan only, re-run with --apply to make the changes)")
+	}
+
+	if failed {
+		return errors.New("failed to correct some domains")
+	}
+	return nil
+}
+
+func planReconciliation(acc *AccountConfig) ([]*domainPlan, error) {
+	var mu sync.Mutex
+	var plans []*domainPlan
+
+	var eg errgroup.Group
+	eg.SetLimit(reconcileConcurrency)
+	for d, err := range qcdn.AllDomains(acc.qiniuCreds, qcdn.ReqListDomains{}) {
+		if err != nil {
+			// let the in-flight queries settle before bailing out
+			_ = eg.Wait()
+			return nil, err
+		}
+
+		policy := findHTTPSPolicy(acc, d.Name)
+		if policy == nil {
+			continue
+		}
+
+		eg.Go(func() error {
+			p, err := planOneDomain(acc, policy, d.Name)
+			if err != nil || p == nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			plans = append(plans, p)
+			return nil
+		})
+	}
+
+	err := eg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(plans, func(a, b *domainPlan) int {
+		return strings.Compare(a.domain, b.domain)
+	})
+	return plans, nil
+}
+
+// planOneDomain returns nil if the domain already conforms to the policy.
+func planOneDomain(acc *AccountConfig, policy *HTTPSPolicy, domain string) (*domainPlan, error) {
+	// the listing API doesn't return the full HTTPS config, so always query
+	details, err := qcdn.GetDomain(acc.qiniuCreds, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if details.IsFrozen() || details.IsOffline() {
+		slog.Debug("domain not online, skipping", "account", acc.DisplayName, "domain", domain)
+		return nil, nil
+	}
+
+	cur := details.HTTPS
+	if cur == nil || len(cur.CertID) == 0 {
+		if policy.ForceHTTPS != nil && *policy.ForceHTTPS || policy.HTTP2 != nil && *policy.HTTP2 {
+			return &domainPlan{domain: domain, skipMsg: "HTTPS not enabled"}, nil
+		}
+		return nil, nil
+	}
+
+	desired, drifts := policy.apply(cur)
+	if len(drifts) == 0 {
+		return nil, nil
+	}
+
+	return &domainPlan{domain: domain, current: cur, desired: desired, drifts: drifts}, nil
+}
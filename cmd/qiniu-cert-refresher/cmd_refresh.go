@@ -0,0 +1,47 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+func cmdRefresh(cCtx *cli.Context) error {
+	key := cCtx.Args().First()
+	if len(key) == 0 {
+		return errors.New("a tracing key must be specified")
+	}
+	slog.Debug("invoked the refresh command", "key", key)
+
+	journal, err := createRotationJournalForKey(cCtx, key)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	failFast := cCtx.Bool("fail-fast")
+	reports := forEachAccount(cCtx, func(acc *AccountConfig, report *accountReport) error {
+		jrnl := journal.forAccount(acc)
+		jrnl.recordAccount(journalBegin, "")
+
+		err := refreshForAccount(acc, key, "", report, jrnl, failFast)
+		if err != nil {
+			slog.Error("failed to refresh", "account", acc.DisplayName, "key", key, "err", err)
+			return err
+		}
+		jrnl.recordAccount(journalDone, "")
+		return nil
+	})
+
+	numFailed := printUploadSummary(os.Stdout, reports)
+	if numFailed > 0 {
+		slog.Info("outstanding domain updates can be retried with the resume command", "journal", journal.path)
+		return fmt.Errorf("%d of %d account(s) failed", numFailed, len(reports))
+	}
+	return journal.complete()
+}
@@ -0,0 +1,245 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+const resumeConcurrency = 8
+
+func cmdResume(cCtx *cli.Context) error {
+	paths := cCtx.Args().Slice()
+	if len(paths) == 0 {
+		journalDir, err := stateSubdir(cCtx, "journal")
+		if err != nil {
+			return err
+		}
+		pruneJournalArchive(journalDir, time.Now())
+		paths, err = filepath.Glob(filepath.Join(journalDir, "*.jsonl"))
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg := getConfig(cCtx.Context)
+	var reports []*accountReport
+	numResumed := 0
+	for _, path := range paths {
+		r, resumed, err := resumeJournal(cCtx.Context, cfg, path)
+		if err != nil {
+			slog.Error("failed to resume the rotation", "journal", path, "err", err)
+			return err
+		}
+		reports = append(reports, r...)
+		if resumed {
+			numResumed++
+		}
+	}
+
+	if numResumed == 0 {
+		fmt.Println("no unfinished rotation")
+		return nil
+	}
+
+	numFailed := printUploadSummary(os.Stdout, reports)
+	if numFailed > 0 {
+		return fmt.Errorf("%d account(s) still have outstanding domain updates", numFailed)
+	}
+	return nil
+}
+
+// resumeJournal finishes the outstanding accounts and domain updates recorded
+// in the journal at path, returning the reports and whether the journal is
+// unfinished in the first place.
+func resumeJournal(ctx context.Context, cfg *Config, path string) ([]*accountReport, bool, error) {
+	journal, records, err := openRotationJournal(path)
+	if errors.Is(err, errJournalLocked) {
+		slog.Info("skipping rotation still in progress", "journal", path)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer journal.Close()
+
+	if isJournalComplete(records) {
+		slog.Debug("archiving finished rotation", "journal", path)
+		archiveJournal(path)
+		return nil, false, nil
+	}
+	if len(records) == 0 || records[0].Event != journalBegin {
+		// just created, or not a journal at all
+		slog.Warn("skipping journal without a beginning", "journal", path)
+		return nil, false, nil
+	}
+
+	command, key := records[0].Command, records[0].TracingKey
+
+	outstandingAccs := outstandingAccounts(records)
+	outstanding := outstandingUpdates(records)
+	slog.Info(
+		"resuming rotation",
+		"journal", path,
+		"outstandingAccounts", len(outstandingAccs),
+		"outstanding", len(outstanding),
+	)
+
+	reportsByAK := make(map[string]*accountReport)
+	var reports []*accountReport
+	var eg errgroup.Group
+	eg.SetLimit(resumeConcurrency)
+	allAttempted := true
+
+	// accounts failed as a whole are refreshed all over again, which covers
+	// their planned domain updates as well
+	refreshedAKs := make(map[string]struct{})
+	for _, a := range outstandingAccs {
+		refreshedAKs[a.AK] = struct{}{}
+		report := &accountReport{account: a.Account, certID: a.NewCertID}
+		reportsByAK[a.AK] = report
+		reports = append(reports, report)
+
+		acc := findAccountByAK(cfg, a.AK)
+		switch {
+		case acc == nil:
+			report.err = errors.New("account not configured or not selected")
+			allAttempted = false
+			continue
+		case command == "upload" && len(a.NewCertID) == 0:
+			// the cert itself is not kept in the journal
+			report.err = errors.New("the cert was never uploaded to the account, run upload again")
+			continue
+		case len(key) == 0:
+			report.err = errors.New("tracing key unknown to the journal")
+			continue
+		}
+
+		eg.Go(func() error {
+			resumeAccount(acc, key, a.NewCertID, journal.forAccount(acc), report)
+			return nil
+		})
+	}
+
+	for _, u := range outstanding {
+		if _, ok := refreshedAKs[u.AK]; ok {
+			continue
+		}
+
+		report, ok := reportsByAK[u.AK]
+		if !ok {
+			report = &accountReport{account: u.Account, certID: u.NewCertID}
+			reportsByAK[u.AK] = report
+			reports = append(reports, report)
+		}
+
+		acc := findAccountByAK(cfg, u.AK)
+		if acc == nil {
+			// may be deselected on purpose, so just leave it for later
+			report.recordDomain(u.Domain, errors.New("account not configured or not selected"))
+			allAttempted = false
+			continue
+		}
+
+		eg.Go(func() error {
+			resumeDomainUpdate(acc, u, journal.forAccount(acc), report)
+			return nil
+		})
+	}
+	_ = eg.Wait()
+
+	notifyRotation(ctx, cfg, key, time.Time{}, reports)
+
+	if allAttempted && !slices.ContainsFunc(reports, (*accountReport).failed) {
+		err = journal.complete()
+		if err != nil {
+			return reports, true, err
+		}
+	}
+
+	return reports, true, nil
+}
+
+// resumeAccount refreshes the account failed as a whole, to the cert uploaded
+// to it if newCertID is given.
+func resumeAccount(
+	acc *AccountConfig,
+	key string,
+	newCertID string,
+	jrnl *accountJournal,
+	report *accountReport,
+) {
+	err := refreshForAccount(acc, key, newCertID, report, jrnl, false)
+	if err != nil {
+		slog.Error("failed to refresh", "account", acc.DisplayName, "key", key, "err", err)
+		report.err = err
+		return
+	}
+	jrnl.recordAccount(journalDone, report.certID)
+}
+
+// resumeDomainUpdate idempotently makes the planned update u, re-checking the
+// domain's current cert first.
+func resumeDomainUpdate(
+	acc *AccountConfig,
+	u *journalRecord,
+	jrnl *accountJournal,
+	report *accountReport,
+) {
+	d, err := qcdn.GetDomain(acc.qiniuCreds, u.Domain)
+	if err != nil {
+		report.recordDomain(u.Domain, err)
+		jrnl.record(journalFailed, u.Domain, u.OldCertID, u.NewCertID, err)
+		return
+	}
+
+	currentCertID := ""
+	if d.HTTPS != nil {
+		currentCertID = d.HTTPS.CertID
+	}
+
+	switch currentCertID {
+	case u.NewCertID:
+		slog.Debug("domain already updated", "account", acc.DisplayName, "domain", u.Domain)
+		report.recordDomain(u.Domain, nil)
+		jrnl.record(journalDone, u.Domain, u.OldCertID, u.NewCertID, nil)
+
+	case u.OldCertID:
+		err := replaceCertForOneDomain(acc, u.Domain, u.NewCertID)
+		report.recordDomain(u.Domain, err)
+		if err != nil {
+			slog.Error("failed to replace domain cert", "account", acc.DisplayName, "domain", u.Domain, "err", err)
+			jrnl.record(journalFailed, u.Domain, u.OldCertID, u.NewCertID, err)
+			return
+		}
+		jrnl.record(journalDone, u.Domain, u.OldCertID, u.NewCertID, nil)
+
+	default:
+		// someone else has changed the domain since, don't override them
+		reason := fmt.Sprintf("cert changed to '%s' in the meantime", currentCertID)
+		slog.Warn("leaving domain alone", "account", acc.DisplayName, "domain", u.Domain, "reason", reason)
+		report.recordSkippedDomain(u.Domain, reason)
+		jrnl.record(journalSkipped, u.Domain, u.OldCertID, u.NewCertID, errors.New(reason))
+	}
+}
+
+func findAccountByAK(cfg *Config, ak string) *AccountConfig {
+	for _, acc := range cfg.Accounts {
+		if acc.AK == ak {
+			return acc
+		}
+	}
+	return nil
+}
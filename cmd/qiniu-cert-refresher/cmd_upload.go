@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -10,7 +11,7 @@ import (
 	"io"
 	"log/slog"
 	"os"
-	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -29,33 +30,118 @@ func cmdUpload(cCtx *cli.Context) error {
 	if len(certPath) == 0 {
 		return errors.New("a certificate chain file must be given")
 	}
-	if len(pemPath) == 0 {
-		return errors.New("a private key file must be given")
-	}
 	if len(key) == 0 {
 		return errors.New("a tracing key for the certificate must be specified")
 	}
 	slog.Debug("invoked the upload command", "cert", certPath, "pem", pemPath, "key", key)
 
-	payloadBase, err := preparePartialUploadPayload(certPath, pemPath)
+	inputOpts, err := makeCertInputOptions(cCtx)
+	if err != nil {
+		return err
+	}
+	payloadBase, err := preparePartialUploadPayload(cCtx.Context, certPath, pemPath, inputOpts)
 	if err != nil {
 		slog.Error("failed to prepare the upload", "err", err)
 		return err
 	}
+	leaf, err := getLeafCert([]byte(payloadBase.CA))
+	if err != nil {
+		return err
+	}
+	keyType, err := keyTypeOfPublicKey(leaf.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	journal, err := createRotationJournalForKey(cCtx, key)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
 
 	cfg := getConfig(cCtx.Context)
-	for _, acc := range cfg.Accounts {
+	failFast := cCtx.Bool("fail-fast")
+	reports := forEachAccount(cCtx, func(acc *AccountConfig, report *accountReport) error {
+		jrnl := journal.forAccount(acc)
+		jrnl.recordAccount(journalBegin, "")
+
 		payload := *payloadBase
-		payload.Name = deriveCertNameForAccount(acc, key)
+		name, err := acc.certNames.render(key, keyType, leaf, time.Now())
+		if err != nil {
+			return err
+		}
+		payload.Name = name
 
-		err := uploadAndRefreshForAccount(acc, key, &payload)
+		err = uploadAndRefreshForAccount(acc, key, &payload, report, jrnl, failFast)
 		if err != nil {
 			slog.Error("failed to upload and refresh", "account", acc.DisplayName, "key", key, "err", err)
 			return err
 		}
+		jrnl.recordAccount(journalDone, report.certID)
+		return nil
+	})
+
+	numFailed := printUploadSummary(os.Stdout, reports)
+
+	notifyRotation(cCtx.Context, cfg, key, leaf.NotAfter, reports)
+
+	if numFailed > 0 {
+		slog.Info("outstanding domain updates can be retried with the resume command", "journal", journal.path)
+		return fmt.Errorf("%d of %d account(s) failed", numFailed, len(reports))
 	}
+	return journal.complete()
+}
 
-	return nil
+func createRotationJournalForKey(cCtx *cli.Context, key string) (*rotationJournal, error) {
+	journalDir, err := stateSubdir(cCtx, "journal")
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare the rotation journal: %w", err)
+	}
+	journal, err := createRotationJournal(journalDir, cCtx.Command.Name, key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the rotation journal: %w", err)
+	}
+	slog.Info("recording the rotation", "journal", journal.path)
+	return journal, nil
+}
+
+// forEachAccount runs fn for every account, as many at a time as given with
+// --parallelism, or one after another with --fail-fast, in which case the
+// accounts after a failed one are skipped. Errors returned by fn go to the
+// reports.
+func forEachAccount(cCtx *cli.Context, fn func(acc *AccountConfig, report *accountReport) error) []*accountReport {
+	cfg := getConfig(cCtx.Context)
+	failFast := cCtx.Bool("fail-fast")
+	reports := make([]*accountReport, len(cfg.Accounts))
+
+	var eg errgroup.Group
+	if failFast {
+		// process one account after another, stopping at the first failure
+		eg.SetLimit(1)
+	} else {
+		eg.SetLimit(max(cCtx.Int("parallelism"), 1))
+	}
+
+	for i, acc := range cfg.Accounts {
+		report := newAccountReport(acc)
+		reports[i] = report
+
+		eg.Go(func() error {
+			if failFast && slices.ContainsFunc(reports[:i], (*accountReport).failed) {
+				report.err = errors.New("skipped due to an earlier failure")
+				return nil
+			}
+
+			err := fn(acc, report)
+			if err != nil {
+				report.err = err
+			}
+			return nil
+		})
+	}
+	_ = eg.Wait()
+
+	return reports
 }
 
 func readFile(path string) ([]byte, error) {
@@ -69,33 +155,26 @@ func readFile(path string) ([]byte, error) {
 }
 
 func preparePartialUploadPayload(
+	ctx context.Context,
 	certPath string,
 	pemPath string,
+	opts *certInputOptions,
 ) (*qcdn.ReqUploadCert, error) {
-	cert, err := readFile(certPath)
-	if err != nil {
-		return nil, err
-	}
-
-	pem, err := readFile(pemPath)
-	if err != nil {
-		return nil, err
-	}
-
-	cn, err := getCommonNameFromCert(cert)
+	input, err := loadCertInput(ctx, certPath, pemPath, opts)
 	if err != nil {
 		return nil, err
 	}
 
 	return &qcdn.ReqUploadCert{
 		Name:       "", // to be filled in later with per-account customization
-		CommonName: cn,
-		PEM:        string(pem),
-		CA:         string(cert),
+		CommonName: input.leaf.Subject.CommonName,
+		PEM:        string(input.keyPEM),
+		CA:         string(input.chainPEM),
 	}, nil
 }
 
-func getCommonNameFromCert(pemCerts []byte) (string, error) {
+// getLeafCert returns the first cert of the PEM-encoded chain.
+func getLeafCert(pemCerts []byte) (*x509.Certificate, error) {
 	// this is resembling (*crypto/x509.CertPool).AppendCertsFromPEM
 	for len(pemCerts) > 0 {
 		var block *pem.Block
@@ -108,25 +187,19 @@ func getCommonNameFromCert(pemCerts []byte) (string, error) {
 		}
 
 		certBytes := block.Bytes
-		cert, err := x509.ParseCertificate(certBytes)
-		if err != nil {
-			return "", err
-		}
-
-		return cert.Subject.CommonName, nil
+		return x509.ParseCertificate(certBytes)
 	}
 
-	return "", errors.New("no certificate in input")
-}
-
-func deriveCertNameForAccount(acc *AccountConfig, key string) string {
-	return fmt.Sprintf("%s %s (%d)", acc.ManagedCertNamePrefix, key, time.Now().UnixNano())
+	return nil, errors.New("no certificate in input")
 }
 
 func uploadAndRefreshForAccount(
 	acc *AccountConfig,
 	key string,
 	payload *qcdn.ReqUploadCert,
+	report *accountReport,
+	jrnl *accountJournal,
+	failFast bool,
 ) error {
 	slog.Debug("about to upload cert", "account", acc.DisplayName, "certName", payload.Name)
 	newCertID, err := qcdn.UploadCert(acc.qiniuCreds, payload)
@@ -134,11 +207,26 @@ func uploadAndRefreshForAccount(
 		slog.Error("failed to upload cert", "account", acc.DisplayName, "err", err)
 		return err
 	}
+	jrnl.recordAccount(journalUploaded, newCertID)
 
-	return refreshForAccount(acc, key, newCertID)
+	return refreshForAccount(acc, key, newCertID, report, jrnl, failFast)
 }
 
-func refreshForAccount(acc *AccountConfig, key string, newCertID string) error {
+// refreshForAccount binds the domains of the tracing key to newCertID, or to
+// the latest valid cert of every key type if newCertID is empty. The domains
+// are those declared for the key in the config, or else those bound to the
+// other certs of the key. Outcomes of the individual domains go to report and
+// jrnl; unless failFast is true, all domains are attempted even if some of
+// them fail, in which case the returned error only covers failures affecting
+// the account as a whole.
+func refreshForAccount(
+	acc *AccountConfig,
+	key string,
+	newCertID string,
+	report *accountReport,
+	jrnl *accountJournal,
+	failFast bool,
+) error {
 	slog.Debug("about to refresh domains", "account", acc.DisplayName, "key", key, "newCertID", newCertID)
 
 	relevantCerts, err := listAllCertsWithTracingKey(acc, key)
@@ -147,30 +235,36 @@ func refreshForAccount(acc *AccountConfig, key string, newCertID string) error {
 	}
 
 	// if newCertID == "": refresh to the latest-expiring certificate that's valid
-	// (i.e. already past its NotBefore)
+	// (i.e. already past its NotBefore), one for every key type
 	//
 	// if newCertID != "": just use it
+	var targets []*qcdn.Cert
 	if newCertID == "" {
-		targetCert := findLatestNonExpiringValidCert(relevantCerts, time.Now())
-		newCertID = targetCert.ID
-	}
-
-	// sanity check: is newCertID actually belonging to this account & tracing key?
-	if !isCertIDInList(newCertID, relevantCerts) {
-		return fmt.Errorf("the specified cert ID '%s' seems irrelevant to tracing key '%s'", newCertID, key)
+		targets = findLatestCertPerKeyType(acc, relevantCerts, time.Now())
+		if len(targets) == 0 {
+			return fmt.Errorf("no valid certificate found for tracing key '%s'", key)
+		}
+	} else {
+		// sanity check: is newCertID actually belonging to this account & tracing key?
+		newCert := findCertByID(newCertID, relevantCerts)
+		if newCert == nil {
+			return fmt.Errorf("the specified cert ID '%s' seems irrelevant to tracing key '%s'", newCertID, key)
+		}
+		targets = []*qcdn.Cert{newCert}
 	}
+	report.certID = strings.Join(lo.Map(targets, func(c *qcdn.Cert, _ int) string { return c.ID }), ", ")
 
-	certIDsToSupersede := lo.FilterMap(relevantCerts, func(c *qcdn.Cert, _ int) (string, bool) {
-		if c.ID == newCertID {
-			return "", false
+	if tk := acc.findTracingKeyConfig(key); tk != nil {
+		err := bindDeclaredDomains(acc, tk, targets, relevantCerts, report, jrnl)
+		if err != nil && (failFast || !errors.Is(err, errSomeDomainsFailed)) {
+			return err
 		}
-		return c.ID, true
-	})
+		return nil
+	}
 
-	// TODO: parallelize (while respecting some global concurrency limit)
-	for _, oldCertID := range certIDsToSupersede {
-		err := replaceDomainCerts(acc, oldCertID, newCertID)
-		if err != nil {
+	for _, target := range targets {
+		err := supersedeCerts(acc, target, relevantCerts, report, jrnl)
+		if err != nil && (failFast || !errors.Is(err, errSomeDomainsFailed)) {
 			return err
 		}
 	}
@@ -178,29 +272,123 @@ func refreshForAccount(acc *AccountConfig, key string, newCertID string) error {
 	return nil
 }
 
-func makeTracingKeyMatcher(prefix string, key string) (*regexp.Regexp, error) {
-	var sb strings.Builder
-	sb.WriteRune('^')
-	sb.WriteString(regexp.QuoteMeta(prefix))
-	sb.WriteString(`\s*`)
-	sb.WriteString(regexp.QuoteMeta(key))
-	return regexp.Compile(sb.String())
+// supersedeCerts moves the domains bound to the other certs over to target,
+// as far as their preferred key types allow.
+func supersedeCerts(
+	acc *AccountConfig,
+	target *qcdn.Cert,
+	relevantCerts []*qcdn.Cert,
+	report *accountReport,
+	jrnl *accountJournal,
+) error {
+	newKeyType := keyTypeOfManagedCert(acc, target)
+
+	var result error
+	// TODO: parallelize (while respecting some global concurrency limit)
+	for _, oldCert := range relevantCerts {
+		if oldCert.ID == target.ID {
+			continue
+		}
+
+		oldKeyType := keyTypeOfManagedCert(acc, oldCert)
+		shouldRebind := func(domain string) bool {
+			return acc.shouldRebind(domain, oldKeyType, newKeyType)
+		}
+		err := replaceDomainCerts(acc, oldCert.ID, target.ID, shouldRebind, report, jrnl)
+		if err != nil {
+			if !errors.Is(err, errSomeDomainsFailed) {
+				return err
+			}
+			result = err
+		}
+	}
+
+	return result
 }
 
-func listAllCertsWithTracingKey(acc *AccountConfig, key string) ([]*qcdn.Cert, error) {
-	allCerts, err := qcdn.ListAllCerts(acc.qiniuCreds)
+// bindDeclaredDomains binds exactly the domains declared for the tracing key
+// to the targets, each domain going to the first target of a key type it
+// accepts. Undeclared domains are left alone.
+func bindDeclaredDomains(
+	acc *AccountConfig,
+	tk *TracingKeyConfig,
+	targets []*qcdn.Cert,
+	relevantCerts []*qcdn.Cert,
+	report *accountReport,
+	jrnl *accountJournal,
+) error {
+	allDomains, err := qcdn.ListAllDomains(acc.qiniuCreds)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	matcher, err := makeTracingKeyMatcher(acc.ManagedCertNamePrefix, key)
-	if err != nil {
-		return nil, err
+	expected, missing := tk.expectedDomains(allDomains)
+	someFailed := false
+	for _, name := range missing {
+		slog.Error("declared domain not found", "account", acc.DisplayName, "key", tk.Key, "domain", name)
+		report.recordDomain(name, errors.New("declared, but not found"))
+		someFailed = true
+	}
+
+	rebinds := make(map[string][]domainRebind)
+	for _, d := range expected {
+		oldCertID, err := queryCurrentCertID(acc, d.Name)
+		if err != nil {
+			slog.Error("failed to query domain", "account", acc.DisplayName, "domain", d.Name, "err", err)
+			report.recordDomain(d.Name, err)
+			someFailed = true
+			continue
+		}
+		if len(oldCertID) == 0 {
+			slog.Error("cannot bind a cert to a domain without HTTPS", "account", acc.DisplayName, "domain", d.Name)
+			report.recordDomain(d.Name, errHTTPSNotEnabled)
+			someFailed = true
+			continue
+		}
+
+		oldKeyType := certKeyType("")
+		if c := findCertByID(oldCertID, relevantCerts); c != nil {
+			oldKeyType = keyTypeOfManagedCert(acc, c)
+		}
+		for _, t := range targets {
+			if !acc.shouldRebind(d.Name, oldKeyType, keyTypeOfManagedCert(acc, t)) {
+				continue
+			}
+			if t.ID != oldCertID {
+				rebinds[t.ID] = append(rebinds[t.ID], domainRebind{d.Name, oldCertID})
+			}
+			break
+		}
+	}
+
+	for _, t := range targets {
+		err := rebindDomains(acc, rebinds[t.ID], t.ID, report, jrnl)
+		if err != nil {
+			if !errors.Is(err, errSomeDomainsFailed) {
+				return err
+			}
+			someFailed = true
+		}
+	}
+
+	if someFailed {
+		return errSomeDomainsFailed
+	}
+	return nil
+}
+
+func listAllCertsWithTracingKey(acc *AccountConfig, key string) ([]*qcdn.Cert, error) {
+	var result []*qcdn.Cert
+	for c, err := range qcdn.AllCerts(acc.qiniuCreds, 0) {
+		if err != nil {
+			return nil, err
+		}
+		if k, _, ok := acc.tracingKeyOfCert(c); ok && k == key {
+			result = append(result, c)
+		}
 	}
 
-	return lo.Filter(allCerts, func(c *qcdn.Cert, _ int) bool {
-		return matcher.MatchString(c.Name)
-	}), nil
+	return result, nil
 }
 
 func findLatestNonExpiringValidCert(certs []*qcdn.Cert, epoch time.Time) *qcdn.Cert {
@@ -222,16 +410,45 @@ func findLatestNonExpiringValidCert(certs []*qcdn.Cert, epoch time.Time) *qcdn.C
 	return result
 }
 
-func isCertIDInList(certID string, certs []*qcdn.Cert) bool {
+// findLatestCertPerKeyType returns the latest valid cert of every key type.
+// Certs of unknown key type are only considered if there are no others.
+func findLatestCertPerKeyType(acc *AccountConfig, certs []*qcdn.Cert, epoch time.Time) []*qcdn.Cert {
+	var result []*qcdn.Cert
+	for _, kt := range certKeyTypes {
+		if c := findLatestNonExpiringValidCert(filterCertsByKeyType(acc, certs, kt), epoch); c != nil {
+			result = append(result, c)
+		}
+	}
+	if len(result) == 0 {
+		if c := findLatestNonExpiringValidCert(filterCertsByKeyType(acc, certs, ""), epoch); c != nil {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func findCertByID(certID string, certs []*qcdn.Cert) *qcdn.Cert {
 	for _, c := range certs {
 		if c.ID == certID {
-			return true
+			return c
 		}
 	}
-	return false
+	return nil
 }
 
-func replaceDomainCerts(acc *AccountConfig, oldCertID string, newCertID string) error {
+// errSomeDomainsFailed is returned by rebindDomains and friends when the
+// domains are all attempted but not all of them succeeded, the details being
+// in the report.
+var errSomeDomainsFailed = errors.New("failed to replace the cert of some domains")
+
+func replaceDomainCerts(
+	acc *AccountConfig,
+	oldCertID string,
+	newCertID string,
+	shouldRebind func(domain string) bool,
+	report *accountReport,
+	jrnl *accountJournal,
+) error {
 	slog.Debug(
 		"about to replace domain certs",
 		"account",
@@ -247,21 +464,60 @@ func replaceDomainCerts(acc *AccountConfig, oldCertID string, newCertID string)
 		return err
 	}
 
-	var eg errgroup.Group
+	var rebinds []domainRebind
 	for _, d := range domains {
-		d := d
+		// domains wanting a cert of another key type are left alone
+		if !shouldRebind(d.Name) {
+			slog.Debug(
+				"keeping the cert of another key type",
+				"account", acc.DisplayName,
+				"domain", d.Name,
+				"certID", oldCertID,
+			)
+			continue
+		}
+		rebinds = append(rebinds, domainRebind{d.Name, oldCertID})
+	}
+
+	return rebindDomains(acc, rebinds, newCertID, report, jrnl)
+}
+
+// domainRebind is a domain to be switched over from oldCertID.
+type domainRebind struct {
+	domain    string
+	oldCertID string
+}
+
+func rebindDomains(
+	acc *AccountConfig,
+	rebinds []domainRebind,
+	newCertID string,
+	report *accountReport,
+	jrnl *accountJournal,
+) error {
+	// plan everything before touching anything, so that domains not even
+	// attempted are known after a crash
+	for _, r := range rebinds {
+		jrnl.record(journalPlanned, r.domain, r.oldCertID, newCertID, nil)
+	}
+
+	var eg errgroup.Group
+	for _, r := range rebinds {
 		// TODO: throttle
 		eg.Go(func() error {
-			return replaceCertForOneDomain(acc, d.Name, newCertID)
+			err := replaceCertForOneDomain(acc, r.domain, newCertID)
+			report.recordDomain(r.domain, err)
+			if err != nil {
+				slog.Error("failed to replace domain cert", "account", acc.DisplayName, "domain", r.domain, "err", err)
+				jrnl.record(journalFailed, r.domain, r.oldCertID, newCertID, err)
+				return errSomeDomainsFailed
+			}
+			jrnl.record(journalDone, r.domain, r.oldCertID, newCertID, nil)
+			return nil
 		})
 	}
 
-	err = eg.Wait()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return eg.Wait()
 }
 
 func replaceCertForOneDomain(acc *AccountConfig, domain string, newCertID string) error {
@@ -271,11 +527,14 @@ func replaceCertForOneDomain(acc *AccountConfig, domain string, newCertID string
 		return err
 	}
 
-	cfg := details.HTTPS
-	slog.Debug("got current HTTPS config", "account", acc.DisplayName, "domain", domain, "cfg", cfg)
+	oldCfg := details.HTTPS
+	slog.Debug("got current HTTPS config", "account", acc.DisplayName, "domain", domain, "cfg", oldCfg)
 
-	cfg.CertID = newCertID
+	// only the cert is changed, HTTPS policies are enforced by reconcile
+	newCfg := *oldCfg
+	newCfg.CertID = newCertID
+	cfg := &newCfg
 
 	slog.Debug("about to update HTTPS config", "account", acc.DisplayName, "domain", domain, "cfg", cfg)
-	return qcdn.UpdateHTTPSConfig(acc.qiniuCreds, domain, cfg)
+	return qcdn.UpdateHTTPSConfigAudited(acc.qiniuCreds, domain, oldCfg, cfg)
 }
@@ -4,50 +4,214 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
-	"strconv"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/qiniu/go-sdk/v7/auth"
+	"gopkg.in/yaml.v3"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qiniucommon"
 )
 
 const defaultManagedCertNamePrefix = "[QCR-Managed]"
 const defaultConfigPath = "qcr-config.toml"
 
 type Config struct {
-	Accounts []*AccountConfig `toml:"accounts"`
+	// Audit 审计日志配置，留空则不记录审计日志
+	Audit *AuditConfig `toml:"audit" yaml:"audit" json:"audit"`
+	// Notifications 通知渠道，证书轮换等事件发生时向其推送消息
+	Notifications []*NotificationConfig `toml:"notifications" yaml:"notifications" json:"notifications"`
+	// Chain 证书链补全配置，上传仅含叶证书或不完整证书链时用于补全
+	Chain *ChainConfig `toml:"chain" yaml:"chain" json:"chain"`
+
+	Accounts []*AccountConfig `toml:"accounts" yaml:"accounts" json:"accounts"`
+}
+
+type AuditConfig struct {
+	// File 审计日志文件，每次变更操作向其追加一行 JSON 记录
+	// 各记录以哈希链相连，可用 audit verify 命令检查是否遭到篡改
+	File string `toml:"file" yaml:"file" json:"file"`
+	// Syslog 是否同时将审计记录发往本机 syslog
+	Syslog bool `toml:"syslog" yaml:"syslog" json:"syslog"`
+	// SyslogTag 发往 syslog 时使用的标签，可以留空，意为取工具默认值
+	SyslogTag string `toml:"syslog_tag" yaml:"syslog_tag" json:"syslog_tag"`
 }
 
 type AccountConfig struct {
-	// AK AccessKey
-	AK string `toml:"ak"`
-	// SK SecretKey
-	SK string `toml:"sk"`
+	// AK AccessKey，可以是 secret:// 形式的密钥引用
+	// 在叠加的配置文件中按显示名称覆盖先前的账号时可以省略
+	AK string `toml:"ak" yaml:"ak" json:"ak"`
+	// SK SecretKey，可以是 secret:// 形式的密钥引用
+	SK string `toml:"sk" yaml:"sk" json:"sk" redact:"true"`
+	// SKFile 从该文件读取 SecretKey，与 SK、SKCommand 互斥
+	SKFile string `toml:"sk_file" yaml:"sk_file" json:"sk_file"`
+	// SKCommand 执行该命令（如 `pass show qiniu/sk`），以其标准输出为 SecretKey，
+	// 与 SK、SKFile 互斥
+	SKCommand string `toml:"sk_command" yaml:"sk_command" json:"sk_command"`
 	// DisplayName 此账号的名称，仅用于日志、调试信息等显示用途
 	// 可以留空，该账号在展示时将仅体现 AK 的头尾几个字符
-	DisplayName string `toml:"display_name"`
+	DisplayName string `toml:"display_name" yaml:"display_name" json:"display_name"`
 	// ManagedCertNamePrefix 由本工具管理的证书名称的前缀，用于自动识别这部分证书记录与相关的域名
 	// 可以留空，意为取工具默认值
-	ManagedCertNamePrefix string `toml:"managed_cert_name_prefix"`
+	ManagedCertNamePrefix string `toml:"managed_cert_name_prefix" yaml:"managed_cert_name_prefix" json:"managed_cert_name_prefix"` //nolint:lll
+	// CertNameTemplate 由本工具上传的证书的命名模板（Go text/template 语法），可用字段为
+	// .Prefix（即 ManagedCertNamePrefix）、.Key（追踪键）、.KeyType（rsa 或 ecdsa）、
+	// .Date（签发日期，如 20260102）、.Fingerprint（证书 SHA-256 指纹的前 8 位）、
+	// .Timestamp（上传时刻的 Unix 纳秒时间戳）；其中 .Prefix 与 .Key 必须出现，
+	// 且各字段须原样输出，以便从证书名称中解析出追踪键
+	// 可以留空，意为取工具默认值；旧版本格式的证书名称总是能被识别
+	CertNameTemplate string `toml:"cert_name_template" yaml:"cert_name_template" json:"cert_name_template"`
+	// Tags 账号标签，用于以 --account-tag 选择要操作的账号
+	// 通过环境变量配置时，以英文逗号分隔
+	Tags []string `toml:"tags" yaml:"tags" json:"tags"`
+	// KeyType 同一追踪键下同时存在 RSA 与 ECDSA 证书时，域名应绑定的证书密钥类型，
+	// 可以是 rsa 或 ecdsa；留空则各域名保持其现用证书的密钥类型
+	// 可被 HTTPS 策略中的同名配置按域名覆盖
+	KeyType string `toml:"key_type" yaml:"key_type" json:"key_type"`
+	// HTTPSPolicies 对该账号下域名期望的 HTTPS 配置，按顺序匹配，先匹配者生效
+	HTTPSPolicies []*HTTPSPolicy `toml:"https_policies" yaml:"https_policies" json:"https_policies"`
+	// TracingKeys 各追踪键的证书应绑定的域名；未在此声明的追踪键，其新证书将绑定旧证书所绑定的域名
+	TracingKeys []*TracingKeyConfig `toml:"tracing_keys" yaml:"tracing_keys" json:"tracing_keys"`
 
 	qiniuCreds *auth.Credentials
+	certNames  *certNameFormat
+	// adopted are the adopted certs of the account, keyed by cert ID
+	adopted map[string]*adoptedCert
 }
 
 func defaultDisplayNameFromAK(ak string) string {
+	if len(ak) < 8 {
+		// too short to reveal anything
+		return "***"
+	}
 	return fmt.Sprintf("%s***%s", ak[:3], ak[len(ak)-3:])
 }
 
-func (x *AccountConfig) postinit() {
+// postinit finishes the account config, idx being the 1-based position of the
+// account for use in error messages.
+func (x *AccountConfig) postinit(idx int) error {
+	err := x.resolveSecrets()
+	if err != nil {
+		name := x.DisplayName
+		if name == "" {
+			name = fmt.Sprintf("#%d", idx)
+		}
+		return fmt.Errorf("account %s: %w", name, err)
+	}
+
+	x.applyDefaults()
+
+	x.certNames, err = newCertNameFormat(x.ManagedCertNamePrefix, x.CertNameTemplate)
+	if err != nil {
+		return fmt.Errorf("account %s: %w", x.DisplayName, err)
+	}
+
+	if len(x.KeyType) > 0 {
+		kt, err := parseCertKeyType(x.KeyType)
+		if err != nil {
+			return fmt.Errorf("account %s: %w", x.DisplayName, err)
+		}
+		x.KeyType = string(kt)
+	}
+
+	for i, p := range x.HTTPSPolicies {
+		err := p.postinit()
+		if err != nil {
+			return fmt.Errorf("account %s: HTTPS policy #%d: %w", x.DisplayName, i+1, err)
+		}
+	}
+
+	seenKeys := make(map[string]struct{})
+	for _, t := range x.TracingKeys {
+		err := t.postinit()
+		if err != nil {
+			return fmt.Errorf("account %s: %w", x.DisplayName, err)
+		}
+		if _, ok := seenKeys[t.Key]; ok {
+			return fmt.Errorf("account %s: tracing key '%s' declared more than once", x.DisplayName, t.Key)
+		}
+		seenKeys[t.Key] = struct{}{}
+	}
+
+	qiniucommon.RegisterSecret(x.SK)
+	x.qiniuCreds = auth.New(x.AK, x.SK)
+	return nil
+}
+
+func (x *AccountConfig) applyDefaults() {
 	if x.DisplayName == "" {
 		x.DisplayName = defaultDisplayNameFromAK(x.AK)
 	}
 	if x.ManagedCertNamePrefix == "" {
 		x.ManagedCertNamePrefix = defaultManagedCertNamePrefix
 	}
+	if x.CertNameTemplate == "" {
+		x.CertNameTemplate = defaultCertNameTemplate
+	}
+}
 
-	x.qiniuCreds = auth.New(x.AK, x.SK)
+// resolveSecrets replaces secret references in AK and SK with the actual
+// secrets, and loads the SK from SKFile or SKCommand if given.
+func (x *AccountConfig) resolveSecrets() error {
+	ctx := context.Background()
+
+	ak, err := resolveSecret(ctx, x.AK)
+	if err != nil {
+		return fmt.Errorf("cannot resolve AK: %w", err)
+	}
+	x.AK = ak
+
+	numSKSources := 0
+	for _, s := range []string{x.SK, x.SKFile, x.SKCommand} {
+		if len(s) > 0 {
+			numSKSources++
+		}
+	}
+	if numSKSources > 1 {
+		return errors.New("only one of sk, sk_file and sk_command can be given")
+	}
+
+	var sk string
+	switch {
+	case len(x.SKFile) > 0:
+		sk, err = readSecretFile(x.SKFile)
+	case len(x.SKCommand) > 0:
+		sk, err = runSecretCommand(ctx, x.SKCommand)
+	default:
+		sk, err = resolveSecret(ctx, x.SK)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot resolve SK: %w", err)
+	}
+	x.SK = sk
+
+	if len(x.AK) == 0 {
+		return errors.New("no AK given")
+	}
+	if len(x.SK) == 0 {
+		return errors.New("no SK given")
+	}
+
+	return nil
+}
+
+var _ slog.LogValuer = (*AccountConfig)(nil)
+
+// LogValue keeps the SK out of logs.
+func (x *AccountConfig) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("displayName", x.DisplayName),
+		slog.String("ak", x.AK),
+		slog.String("managedCertNamePrefix", x.ManagedCertNamePrefix),
+	)
 }
 
 //////////////////////////////////////////////////////////////////////////////
@@ -62,83 +226,126 @@ func getConfig(ctx context.Context) *Config {
 	return ctx.Value(ctxConfigKey{}).(*Config)
 }
 
-//////////////////////////////////////////////////////////////////////////////
+// getSingleAccount returns the only configured account, for commands that
+// don't make sense to run against several accounts at once.
+func getSingleAccount(cfg *Config) (*AccountConfig, error) {
+	switch len(cfg.Accounts) {
+	case 0:
+		return nil, errors.New("no account configured")
+	case 1:
+		return cfg.Accounts[0], nil
+	default:
+		return nil, fmt.Errorf("this command works on exactly one account, but %d are configured", len(cfg.Accounts))
+	}
+}
 
-func configFromTOML(path string) (*Config, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// selectionName returns the display name the account is selected by, which
+// works before postinit as well, so accounts can be selected without
+// resolving the secrets of every other account. The name derived from an AK
+// given as a secret reference is unknown at that point, and the empty string
+// is returned instead.
+func (x *AccountConfig) selectionName() string {
+	if len(x.DisplayName) > 0 || isSecretRef(x.AK) {
+		return x.DisplayName
 	}
-	defer f.Close()
+	return defaultDisplayNameFromAK(x.AK)
+}
 
-	data, err := io.ReadAll(f)
-	if err != nil {
-		return nil, err
+// selectAccounts narrows cfg down to the accounts named by names or having
+// any of tags, keeping all accounts if no selector is given. Every selector
+// must match at least one account, so typos don't go unnoticed.
+func selectAccounts(cfg *Config, names []string, tags []string) error {
+	if len(names) == 0 && len(tags) == 0 {
+		return nil
 	}
 
-	var cfg Config
-	_, err = toml.Decode(string(data), &cfg)
-	if err != nil {
-		return nil, err
+	for _, name := range names {
+		if !slices.ContainsFunc(cfg.Accounts, func(x *AccountConfig) bool { return x.selectionName() == name }) {
+			return fmt.Errorf("no account named '%s'", name)
+		}
+	}
+	for _, tag := range tags {
+		if !slices.ContainsFunc(cfg.Accounts, func(x *AccountConfig) bool { return slices.Contains(x.Tags, tag) }) {
+			return fmt.Errorf("no account tagged '%s'", tag)
+		}
 	}
 
-	for _, acc := range cfg.Accounts {
-		acc.postinit()
+	cfg.Accounts = slices.DeleteFunc(cfg.Accounts, func(x *AccountConfig) bool {
+		if slices.Contains(names, x.selectionName()) {
+			return false
+		}
+		return !slices.ContainsFunc(x.Tags, func(t string) bool { return slices.Contains(tags, t) })
+	})
+	slog.Debug("selected accounts", "count", len(cfg.Accounts))
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+
+type configFormat string
+
+const (
+	configFormatTOML configFormat = "toml"
+	configFormatYAML configFormat = "yaml"
+	configFormatJSON configFormat = "json"
+)
+
+// configFormatFromPath selects the format by file extension, defaulting to
+// TOML.
+func configFormatFromPath(path string) configFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return configFormatYAML
+	case ".json":
+		return configFormatJSON
+	default:
+		return configFormatTOML
 	}
+}
 
+func decodeConfig(format configFormat, data []byte) (*Config, error) {
+	var cfg Config
+	var err error
+	switch format {
+	case configFormatYAML:
+		err = yaml.Unmarshal(data, &cfg)
+	case configFormatJSON:
+		err = json.Unmarshal(data, &cfg)
+	default:
+		_, err = toml.Decode(string(data), &cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
-func configFromEnv() (*Config, error) {
-	numAccountsStr := os.Getenv("QCR_NUM_ACCOUNTS")
-	if len(numAccountsStr) == 0 {
-		return nil, nil
+// readConfigFile decodes the config file without finishing it, so it can be
+// merged with other layers first.
+func readConfigFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	numAccounts, err := strconv.ParseInt(numAccountsStr, 10, 0)
+	data, err := io.ReadAll(f)
 	if err != nil {
 		return nil, err
 	}
 
-	var accounts []*AccountConfig
-	for i := 1; i <= int(numAccounts); i++ {
-		accCfg, err := accountConfigFromEnv(i)
-		if err != nil {
-			return nil, err
-		}
-		accCfg.postinit()
-		accounts = append(accounts, accCfg)
+	cfg, err := decodeConfig(configFormatFromPath(path), data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
 
-	return &Config{Accounts: accounts}, nil
+	return cfg, nil
 }
 
+// envNumAccounts is the number of accounts, which must all be given in the
+// environment if set and no config file is explicitly given.
+const envNumAccounts = "QCR_NUM_ACCOUNTS"
+
 func envKey(idx int, kind string) string {
 	return fmt.Sprintf("QCR_ACCOUNT_%d_%s", idx, kind)
 }
-
-func getenvForAccount(idx int, kind string) string {
-	return os.Getenv(envKey(idx, kind))
-}
-
-func accountConfigFromEnv(idx int) (*AccountConfig, error) {
-	ak := getenvForAccount(idx, "AK")
-	if len(ak) == 0 {
-		return nil, fmt.Errorf("no AK for account #%d", idx)
-	}
-
-	sk := getenvForAccount(idx, "SK")
-	if len(sk) == 0 {
-		return nil, fmt.Errorf("no SK for account #%d", idx)
-	}
-
-	displayName := getenvForAccount(idx, "DISPLAY_NAME")
-	prefix := getenvForAccount(idx, "MANAGED_CERT_NAME_PREFIX")
-
-	return &AccountConfig{
-		AK:                    ak,
-		SK:                    sk,
-		DisplayName:           displayName,
-		ManagedCertNamePrefix: prefix,
-	}, nil
-}
@@ -0,0 +1,717 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/qiniu/go-sdk/v7/auth"
+	"gopkg.in/yaml.v3"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+	"github.com/xen0n/qiniu-cert-refresher/api/qiniucommon"
+)
+
+// expectedKeyLength is the length of Qiniu AKs and SKs.
+const expectedKeyLength = 40
+
+type diagSeverity string
+
+const (
+	sevError   diagSeverity = "error"
+	sevWarning diagSeverity = "warning"
+)
+
+type diagnostic struct {
+	loc      string
+	severity diagSeverity
+	msg      string
+}
+
+func (d diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.loc, d.severity, d.msg)
+}
+
+// configLocator maps parts of the config back to where they are defined, for
+// use in diagnostics. Indices are 0-based.
+type configLocator interface {
+	whole() string
+	account(idx int) string
+	accountField(idx int, key string) string
+	policy(accIdx int, policyIdx int) string
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+var (
+	tomlAccountHeaderRE = regexp.MustCompile(`^\s*\[\[\s*accounts\s*\]\]`)
+	tomlPolicyHeaderRE  = regexp.MustCompile(`^\s*\[\[\s*accounts\s*\.\s*https_policies\s*\]\]`)
+	tomlAnyHeaderRE     = regexp.MustCompile(`^\s*\[`)
+	tomlHeaderRE        = regexp.MustCompile(`^\s*\[\[?([^\[\]]+)\]\]?\s*(?:#.*)?$`)
+	tomlAssignmentRE    = regexp.MustCompile(`^\s*([A-Za-z0-9_\-."' ]+?)\s*=`)
+)
+
+// tomlLocator finds things in TOML source by simple line matching, which is
+// good enough for configs written in the usual array-of-tables style.
+type tomlLocator struct {
+	path           string
+	lines          []string
+	accountHeaders []int // 0-based line indices
+}
+
+var _ configLocator = (*tomlLocator)(nil)
+
+func newTOMLLocator(path string, src []byte) *tomlLocator {
+	l := tomlLocator{
+		path:  path,
+		lines: strings.Split(string(src), "\n"),
+	}
+	for i, line := range l.lines {
+		if tomlAccountHeaderRE.MatchString(line) {
+			l.accountHeaders = append(l.accountHeaders, i)
+		}
+	}
+	return &l
+}
+
+func (l *tomlLocator) at(lineIdx int) string {
+	return fmt.Sprintf("%s:%d", l.path, lineIdx+1)
+}
+
+func (l *tomlLocator) whole() string {
+	return l.path
+}
+
+func (l *tomlLocator) account(idx int) string {
+	if idx >= len(l.accountHeaders) {
+		return l.path
+	}
+	return l.at(l.accountHeaders[idx])
+}
+
+// accountRegion returns the line range [start, end) of the account's table,
+// including its sub-tables.
+func (l *tomlLocator) accountRegion(idx int) (int, int) {
+	start := l.accountHeaders[idx]
+	end := len(l.lines)
+	if idx+1 < len(l.accountHeaders) {
+		end = l.accountHeaders[idx+1]
+	}
+	return start, end
+}
+
+func (l *tomlLocator) accountField(idx int, key string) string {
+	if idx >= len(l.accountHeaders) {
+		return l.path
+	}
+
+	re := tomlKeyLineRE(key)
+	start, end := l.accountRegion(idx)
+	for i := start + 1; i < end; i++ {
+		if tomlAnyHeaderRE.MatchString(l.lines[i]) {
+			break
+		}
+		if re.MatchString(l.lines[i]) {
+			return l.at(i)
+		}
+	}
+	return l.account(idx)
+}
+
+func (l *tomlLocator) policy(accIdx int, policyIdx int) string {
+	if accIdx >= len(l.accountHeaders) {
+		return l.path
+	}
+
+	start, end := l.accountRegion(accIdx)
+	n := 0
+	for i := start + 1; i < end; i++ {
+		if tomlPolicyHeaderRE.MatchString(l.lines[i]) {
+			if n == policyIdx {
+				return l.at(i)
+			}
+			n++
+		}
+	}
+	return l.account(accIdx)
+}
+
+// undecodedKeys reports the keys the decoder didn't use, which are most likely
+// typos. The keys are located by their full paths, following the table
+// headers, and repeated keys in order of appearance.
+func (l *tomlLocator) undecodedKeys(md toml.MetaData) []diagnostic {
+	var result []diagnostic
+	seen := make(map[string]int)
+	for _, k := range md.Undecoded() {
+		path := k.String()
+
+		loc := l.path
+		n := 0
+		var table []string
+		for i, line := range l.lines {
+			if header, ok := parseTOMLHeader(line); ok {
+				table = header
+				continue
+			}
+			key, ok := parseTOMLKeyLine(line)
+			if !ok || !slices.Equal(k, slices.Concat(table, key)) {
+				continue
+			}
+			if n == seen[path] {
+				loc = l.at(i)
+				break
+			}
+			n++
+		}
+		seen[path]++
+
+		result = append(result, diagnostic{loc, sevError, fmt.Sprintf("unknown key '%s'", k)})
+	}
+	return result
+}
+
+// parseTOMLHeader returns the path of the table or array of tables declared
+// by line, if it is a header.
+func parseTOMLHeader(line string) ([]string, bool) {
+	m := tomlHeaderRE.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	return splitTOMLDottedKey(m[1]), true
+}
+
+// parseTOMLKeyLine returns the possibly dotted key assigned on line, if any.
+func parseTOMLKeyLine(line string) ([]string, bool) {
+	m := tomlAssignmentRE.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	return splitTOMLDottedKey(m[1]), true
+}
+
+// splitTOMLDottedKey splits a dotted key, not bothering with dots inside
+// quoted parts.
+func splitTOMLDottedKey(s string) []string {
+	parts := strings.Split(s, ".")
+	for i, p := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(p), `"'`)
+	}
+	return parts
+}
+
+func tomlKeyLineRE(key string) *regexp.Regexp {
+	q := regexp.QuoteMeta(key)
+	return regexp.MustCompile(`^\s*(?:` + q + `|"` + q + `"|'` + q + `')\s*=`)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// layeredLocator locates things of the merged config in the layers they came
+// from, by way of the locators of the individual config files.
+type layeredLocator struct {
+	lc    *layeredConfig
+	files map[string]configLocator
+	// order lists the merged files in increasing order of precedence
+	order []string
+}
+
+var _ configLocator = (*layeredLocator)(nil)
+
+func (l *layeredLocator) whole() string {
+	return "merged configuration"
+}
+
+func (l *layeredLocator) account(idx int) string {
+	// the account is first defined by the least preferred file having it
+	for _, path := range l.order {
+		if fileIdx, ok := l.lc.fileIndices[path][idx]; ok {
+			return l.files[path].account(fileIdx)
+		}
+	}
+	return l.accountField(idx, "ak")
+}
+
+func (l *layeredLocator) accountField(idx int, key string) string {
+	source, ok := l.lc.sources[fmt.Sprintf("accounts[%d].%s", idx, key)]
+	if !ok {
+		return fmt.Sprintf("account #%d", idx+1)
+	}
+
+	if envName, ok := strings.CutPrefix(source, "env "); ok {
+		return envName
+	}
+
+	fileIdx, ok := l.lc.fileIndices[source][idx]
+	if !ok {
+		return source
+	}
+	return l.files[source].accountField(fileIdx, key)
+}
+
+func (l *layeredLocator) policy(accIdx int, policyIdx int) string {
+	// policies come as a whole from one layer
+	source := l.lc.sources[fmt.Sprintf("accounts[%d].https_policies", accIdx)]
+	fileIdx, ok := l.lc.fileIndices[source][accIdx]
+	if !ok {
+		return l.accountField(accIdx, "https_policies")
+	}
+	return l.files[source].policy(fileIdx, policyIdx)
+}
+
+// unknownEnvKeys reports QCR_* variables that are not going to be used.
+func unknownEnvKeys(numAccounts int) []diagnostic {
+	known := map[string]struct{}{envNumAccounts: {}}
+	t := reflect.TypeFor[AccountConfig]()
+	for i := 1; i <= numAccounts; i++ {
+		for j := 0; j < t.NumField(); j++ {
+			key, ok := configFieldName(t.Field(j))
+			if ok && isEnvSettable(t.Field(j).Type) {
+				known[envKey(i, strings.ToUpper(key))] = struct{}{}
+			}
+		}
+	}
+
+	var result []diagnostic
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(k, "QCR_") {
+			continue
+		}
+		if _, ok := known[k]; !ok {
+			result = append(result, diagnostic{k, sevWarning, "unknown or unused variable"})
+		}
+	}
+	return result
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// pathLocator locates things by the line numbers of their config paths, like
+// "accounts[0].ak", as recorded while parsing formats that keep track of
+// positions.
+type pathLocator struct {
+	path  string
+	lines map[string]int // 1-based
+}
+
+var _ configLocator = (*pathLocator)(nil)
+
+func (l *pathLocator) locate(configPath string, fallback string) string {
+	if line, ok := l.lines[configPath]; ok {
+		return fmt.Sprintf("%s:%d", l.path, line)
+	}
+	return fallback
+}
+
+func (l *pathLocator) whole() string {
+	return l.path
+}
+
+func (l *pathLocator) account(idx int) string {
+	return l.locate(fmt.Sprintf("accounts[%d]", idx), l.path)
+}
+
+func (l *pathLocator) accountField(idx int, key string) string {
+	return l.locate(fmt.Sprintf("accounts[%d].%s", idx, key), l.account(idx))
+}
+
+func (l *pathLocator) policy(accIdx int, policyIdx int) string {
+	return l.locate(fmt.Sprintf("accounts[%d].https_policies[%d]", accIdx, policyIdx), l.account(accIdx))
+}
+
+func (l *pathLocator) unknownKeys(generic any) []diagnostic {
+	keys := unknownConfigKeys(generic, reflect.TypeFor[Config](), "")
+	slices.Sort(keys)
+
+	result := make([]diagnostic, len(keys))
+	for i, k := range keys {
+		result[i] = diagnostic{l.locate(k, l.path), sevError, fmt.Sprintf("unknown key '%s'", k)}
+	}
+	return result
+}
+
+func recordYAMLLines(n *yaml.Node, configPath string, lines map[string]int) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			recordYAMLLines(c, configPath, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p := joinConfigPath(configPath, n.Content[i].Value)
+			lines[p] = n.Content[i].Line
+			recordYAMLLines(n.Content[i+1], p, lines)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			p := fmt.Sprintf("%s[%d]", configPath, i)
+			lines[p] = c.Line
+			recordYAMLLines(c, p, lines)
+		}
+	}
+}
+
+var yamlErrorLineRE = regexp.MustCompile(`line (\d+): (.*)`)
+
+func yamlErrorDiags(path string, err error) []diagnostic {
+	var msgs []string
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		msgs = te.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+
+	result := make([]diagnostic, len(msgs))
+	for i, msg := range msgs {
+		loc := path
+		if m := yamlErrorLineRE.FindStringSubmatch(msg); m != nil {
+			loc = path + ":" + m[1]
+			msg = m[2]
+		}
+		result[i] = diagnostic{loc, sevError, strings.TrimPrefix(msg, "yaml: ")}
+	}
+	return result
+}
+
+func checkYAMLConfig(path string, data []byte) ([]*AccountConfig, configLocator, []diagnostic) {
+	var root yaml.Node
+	err := yaml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, nil, yamlErrorDiags(path, err)
+	}
+
+	var cfg Config
+	err = root.Decode(&cfg)
+	if err != nil {
+		return nil, nil, yamlErrorDiags(path, err)
+	}
+
+	var generic any
+	err = root.Decode(&generic)
+	if err != nil {
+		return nil, nil, yamlErrorDiags(path, err)
+	}
+
+	loc := pathLocator{path: path, lines: make(map[string]int)}
+	recordYAMLLines(&root, "", loc.lines)
+	return cfg.Accounts, &loc, loc.unknownKeys(generic)
+}
+
+// jsonLineRecorder records the line numbers of config paths by walking the
+// token stream, as encoding/json doesn't keep positions.
+type jsonLineRecorder struct {
+	data  []byte
+	dec   *json.Decoder
+	lines map[string]int
+}
+
+func (r *jsonLineRecorder) lineAt(offset int64) int {
+	// skip to the start of the next token
+	for offset < int64(len(r.data)) && strings.ContainsRune(" \t\r\n,:", rune(r.data[offset])) {
+		offset++
+	}
+	return bytes.Count(r.data[:offset], []byte{'\n'}) + 1
+}
+
+func (r *jsonLineRecorder) value(configPath string) error {
+	tok, err := r.dec.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+
+	switch delim {
+	case '{':
+		for r.dec.More() {
+			line := r.lineAt(r.dec.InputOffset())
+			keyTok, err := r.dec.Token()
+			if err != nil {
+				return err
+			}
+
+			p := joinConfigPath(configPath, keyTok.(string))
+			r.lines[p] = line
+			err = r.value(p)
+			if err != nil {
+				return err
+			}
+		}
+	case '[':
+		for i := 0; r.dec.More(); i++ {
+			p := fmt.Sprintf("%s[%d]", configPath, i)
+			r.lines[p] = r.lineAt(r.dec.InputOffset())
+			err := r.value(p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the closing delimiter
+	_, err = r.dec.Token()
+	return err
+}
+
+func checkJSONConfig(path string, data []byte) ([]*AccountConfig, configLocator, []diagnostic) {
+	lineAt := func(offset int64) string {
+		return fmt.Sprintf("%s:%d", path, bytes.Count(data[:min(offset, int64(len(data)))], []byte{'\n'})+1)
+	}
+
+	var generic any
+	err := json.Unmarshal(data, &generic)
+	if err != nil {
+		var se *json.SyntaxError
+		if errors.As(err, &se) {
+			return nil, nil, []diagnostic{{lineAt(se.Offset), sevError, se.Error()}}
+		}
+		return nil, nil, []diagnostic{{path, sevError, err.Error()}}
+	}
+
+	var cfg Config
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			return nil, nil, []diagnostic{{lineAt(te.Offset), sevError, te.Error()}}
+		}
+		return nil, nil, []diagnostic{{path, sevError, err.Error()}}
+	}
+
+	loc := pathLocator{path: path, lines: make(map[string]int)}
+	rec := jsonLineRecorder{data: data, dec: json.NewDecoder(bytes.NewReader(data)), lines: loc.lines}
+	err = rec.value("")
+	if err != nil {
+		return nil, nil, []diagnostic{{path, sevError, err.Error()}}
+	}
+
+	return cfg.Accounts, &loc, loc.unknownKeys(generic)
+}
+
+// checkConfigFile decodes the config file strictly, in the format selected by
+// its extension.
+func checkConfigFile(path string) ([]*AccountConfig, configLocator, []diagnostic) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, nil, []diagnostic{{path, sevError, err.Error()}}
+	}
+
+	switch configFormatFromPath(path) {
+	case configFormatYAML:
+		return checkYAMLConfig(path, data)
+	case configFormatJSON:
+		return checkJSONConfig(path, data)
+	default:
+		return checkTOMLConfig(path, data)
+	}
+}
+
+func checkTOMLConfig(path string, data []byte) ([]*AccountConfig, configLocator, []diagnostic) {
+	var cfg Config
+	md, err := toml.Decode(string(data), &cfg)
+	if err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			loc := fmt.Sprintf("%s:%d", path, pe.Position.Line)
+			return nil, nil, []diagnostic{{loc, sevError, pe.Message}}
+		}
+		return nil, nil, []diagnostic{{path, sevError, err.Error()}}
+	}
+
+	loc := newTOMLLocator(path, data)
+	return cfg.Accounts, loc, loc.undecodedKeys(md)
+}
+
+// checkAccounts validates the decoded accounts, resolving their secrets in
+// the process. If verify is true, the credentials are tried against the API
+// with a read-only call.
+func checkAccounts(accounts []*AccountConfig, loc configLocator, verify bool) []diagnostic {
+	var diags []diagnostic
+	report := func(where string, sev diagSeverity, format string, args ...any) {
+		diags = append(diags, diagnostic{where, sev, fmt.Sprintf(format, args...)})
+	}
+
+	if len(accounts) == 0 {
+		report(loc.whole(), sevError, "no account configured")
+		return diags
+	}
+
+	usable := make([]bool, len(accounts))
+	for i, acc := range accounts {
+		if acc == nil {
+			continue
+		}
+
+		for j, p := range acc.HTTPSPolicies {
+			err := p.postinit()
+			if err != nil {
+				report(loc.policy(i, j), sevError, "HTTPS policy #%d: %s", j+1, err)
+				continue
+			}
+			if p.ForceHTTPS == nil && p.HTTP2 == nil && len(p.KeyType) == 0 {
+				report(loc.policy(i, j), sevWarning, "HTTPS policy #%d manages nothing", j+1)
+			}
+		}
+
+		seenKeys := make(map[string]struct{})
+		for _, t := range acc.TracingKeys {
+			err := t.postinit()
+			if err != nil {
+				report(loc.accountField(i, "tracing_keys"), sevError, "account #%d: %s", i+1, err)
+				continue
+			}
+			if _, ok := seenKeys[t.Key]; ok {
+				report(
+					loc.accountField(i, "tracing_keys"),
+					sevError,
+					"account #%d: tracing key '%s' declared more than once",
+					i+1,
+					t.Key,
+				)
+			}
+			seenKeys[t.Key] = struct{}{}
+		}
+
+		if len(acc.KeyType) > 0 {
+			_, err := parseCertKeyType(acc.KeyType)
+			if err != nil {
+				report(loc.accountField(i, "key_type"), sevError, "account #%d: %s", i+1, err)
+			}
+		}
+
+		_, err := newCertNameFormat(acc.ManagedCertNamePrefix, acc.CertNameTemplate)
+		if err != nil {
+			report(loc.accountField(i, "cert_name_template"), sevError, "account #%d: %s", i+1, err)
+		}
+
+		prefixIsBlank := len(acc.ManagedCertNamePrefix) > 0 && strings.TrimSpace(acc.ManagedCertNamePrefix) == ""
+		if prefixIsBlank {
+			report(
+				loc.accountField(i, "managed_cert_name_prefix"),
+				sevError,
+				"managed cert name prefix must not be blank",
+			)
+		}
+
+		err = acc.resolveSecrets()
+		if err != nil {
+			report(loc.account(i), sevError, "account #%d: %s", i+1, err)
+			continue
+		}
+		if len(acc.AK) != expectedKeyLength {
+			report(loc.accountField(i, "ak"), sevWarning, "AK of account #%d doesn't look like a Qiniu AK", i+1)
+		}
+		if len(acc.SK) != expectedKeyLength {
+			report(loc.account(i), sevWarning, "SK of account #%d doesn't look like a Qiniu SK", i+1)
+		}
+
+		acc.applyDefaults()
+		usable[i] = !prefixIsBlank
+	}
+
+	for i, acc := range accounts {
+		if !usable[i] {
+			continue
+		}
+
+		for j := 0; j < i; j++ {
+			other := accounts[j]
+			if !usable[j] {
+				continue
+			}
+
+			if acc.DisplayName == other.DisplayName {
+				report(
+					loc.accountField(i, "display_name"),
+					sevError,
+					"account #%d has the same display name '%s' as account #%d",
+					i+1,
+					acc.DisplayName,
+					j+1,
+				)
+			}
+
+			if acc.AK != other.AK {
+				continue
+			}
+			report(loc.accountField(i, "ak"), sevWarning, "account #%d shares the AK with account #%d", i+1, j+1)
+
+			// certs of one are going to be picked up by the other
+			if strings.HasPrefix(acc.ManagedCertNamePrefix, other.ManagedCertNamePrefix) ||
+				strings.HasPrefix(other.ManagedCertNamePrefix, acc.ManagedCertNamePrefix) {
+				report(
+					loc.accountField(i, "managed_cert_name_prefix"),
+					sevError,
+					"managed cert name prefix '%s' of account #%d conflicts with '%s' of account #%d on the same AK",
+					acc.ManagedCertNamePrefix,
+					i+1,
+					other.ManagedCertNamePrefix,
+					j+1,
+				)
+			}
+		}
+	}
+
+	if !verify {
+		return diags
+	}
+
+	for i, acc := range accounts {
+		if !usable[i] {
+			continue
+		}
+
+		err := verifyCredentials(acc)
+		if errors.Is(err, qiniucommon.ErrAuth) {
+			report(loc.account(i), sevError, "credentials of account #%d are rejected by Qiniu", i+1)
+		} else if err != nil {
+			report(loc.account(i), sevError, "cannot verify credentials of account #%d: %s", i+1, err)
+		}
+	}
+
+	return diags
+}
+
+func verifyCredentials(acc *AccountConfig) error {
+	// fetching the first cert is enough to exercise the credentials
+	for _, err := range qcdn.AllCerts(auth.New(acc.AK, acc.SK), 1) {
+		return err
+	}
+	return nil
+}
+
+// checkNotifications validates the notification channels, reporting them at
+// the layer they come from.
+func checkNotifications(lc *layeredConfig) []diagnostic {
+	where, ok := lc.sources["notifications"]
+	if !ok {
+		return nil
+	}
+	if envName, ok := strings.CutPrefix(where, "env "); ok {
+		where = envName
+	}
+
+	var result []diagnostic
+	for i, nc := range lc.cfg.Notifications {
+		// validate a copy, as postinit fills in defaults
+		x := *nc
+		err := x.postinit()
+		if err != nil {
+			result = append(result, diagnostic{where, sevError, fmt.Sprintf("notification channel #%d: %s", i+1, err)})
+		}
+	}
+	return result
+}
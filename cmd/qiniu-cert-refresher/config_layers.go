@@ -0,0 +1,314 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const systemConfigPath = "/etc/qcr/config.toml"
+
+const sourceDefault = "default"
+
+// userConfigPath returns the per-user config file path, which honors
+// XDG_CONFIG_HOME on Unix-like systems.
+func userConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "qcr", "config.toml")
+}
+
+// configLayerPaths returns the config files to merge, in increasing order of
+// precedence.
+func configLayerPaths(explicitPath string) []string {
+	var result []string
+	result = append(result, systemConfigPath)
+	if p := userConfigPath(); p != "" {
+		result = append(result, p)
+	}
+	if len(explicitPath) > 0 {
+		result = append(result, explicitPath)
+	} else {
+		result = append(result, defaultConfigPath)
+	}
+	return result
+}
+
+// layeredConfig is the result of merging config layers, where later layers
+// override individual fields of earlier ones. Secrets are not resolved yet.
+type layeredConfig struct {
+	cfg Config
+	// sources records where each effective value came from, keyed by config
+	// paths like "accounts[0].sk"
+	sources map[string]string
+	// fileIndices maps, for each merged file, indices of the merged accounts
+	// to their indices in that file
+	fileIndices map[string]map[int]int
+}
+
+// loadLayeredConfig merges, in increasing order of precedence, the system
+// config, the user config, the explicitly given config file (or the one in
+// the working directory) and the environment. Only the explicitly given file
+// is required to exist. If envOnly is true, config files are not consulted.
+func loadLayeredConfig(explicitPath string, envOnly bool) (*layeredConfig, error) {
+	lc := newLayeredConfig()
+
+	if !envOnly {
+		for _, path := range configLayerPaths(explicitPath) {
+			// only the explicitly given file is mandatory
+			err := lc.mergeFile(path, path != explicitPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err := lc.mergeEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lc.cfg.Accounts) == 0 {
+		return nil, errors.New("no account configured")
+	}
+
+	return lc, nil
+}
+
+func newLayeredConfig() *layeredConfig {
+	return &layeredConfig{
+		sources:     make(map[string]string),
+		fileIndices: make(map[string]map[int]int),
+	}
+}
+
+func (lc *layeredConfig) mergeFile(path string, optional bool) error {
+	cfg, err := readConfigFile(path)
+	if err != nil {
+		if optional && errors.Is(err, fs.ErrNotExist) {
+			slog.Debug("optional config file not found", "path", path)
+			return nil
+		}
+		return err
+	}
+
+	slog.Debug("merging config file", "path", path)
+	lc.mergeTopLevel(cfg, path)
+	indices := make(map[int]int)
+	lc.fileIndices[path] = indices
+	// accounts of the same file never override each other
+	numEarlier := len(lc.cfg.Accounts)
+	for fileIdx, acc := range cfg.Accounts {
+		idx := lc.findAccount(acc, numEarlier, indices)
+		if idx < 0 {
+			idx = len(lc.cfg.Accounts)
+			lc.cfg.Accounts = append(lc.cfg.Accounts, &AccountConfig{})
+		}
+		indices[idx] = fileIdx
+		mergeFields(
+			reflect.ValueOf(lc.cfg.Accounts[idx]).Elem(),
+			reflect.ValueOf(acc).Elem(),
+			fmt.Sprintf("accounts[%d]", idx),
+			func(string) string { return path },
+			lc.sources,
+		)
+	}
+
+	return nil
+}
+
+// mergeTopLevel merges everything except the accounts, which are matched up
+// individually.
+func (lc *layeredConfig) mergeTopLevel(cfg *Config, source string) {
+	top := *cfg
+	top.Accounts = nil
+
+	mergeFields(
+		reflect.ValueOf(&lc.cfg).Elem(),
+		reflect.ValueOf(&top).Elem(),
+		"",
+		func(string) string { return source },
+		lc.sources,
+	)
+}
+
+// findAccount returns the index of the account merged from earlier layers,
+// i.e. among the first numEarlier ones, that acc is meant to override,
+// matching by display name, or by AK if acc has no display name. Accounts
+// already overridden by the current file, as recorded in taken, are not
+// matched again. -1 is returned if there is none.
+func (lc *layeredConfig) findAccount(acc *AccountConfig, numEarlier int, taken map[int]int) int {
+	for i, x := range lc.cfg.Accounts[:numEarlier] {
+		if _, ok := taken[i]; ok {
+			continue
+		}
+		if len(acc.DisplayName) > 0 {
+			if x.DisplayName == acc.DisplayName {
+				return i
+			}
+		} else if len(acc.AK) > 0 && x.AK == acc.AK && len(x.DisplayName) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+var accountEnvKeyRE = regexp.MustCompile(`^QCR_ACCOUNT_(\d+)_(.+)$`)
+
+// mergeEnv applies QCR_ACCOUNT_<n>_<FIELD> variables to the n-th account
+// (1-based) of the merged config, creating the account if necessary, in
+// which case the accounts must be numbered without gaps. FIELD is the
+// uppercased config key, e.g. SK_FILE for sk_file.
+func (lc *layeredConfig) mergeEnv() error {
+	overrides := make(map[int]*AccountConfig)
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		m := accountEnvKeyRE.FindStringSubmatch(k)
+		if m == nil || len(v) == 0 {
+			continue
+		}
+
+		idx, err := strconv.Atoi(m[1])
+		if err != nil || idx < 1 {
+			return fmt.Errorf("bad account index in %s", k)
+		}
+
+		acc, ok := overrides[idx]
+		if !ok {
+			acc = &AccountConfig{}
+			overrides[idx] = acc
+		}
+
+		if !setFieldFromEnv(acc, strings.ToLower(m[2]), v) {
+			slog.Warn("ignoring unknown config variable", "name", k)
+		}
+	}
+
+	indices := make([]int, 0, len(overrides))
+	for idx := range overrides {
+		indices = append(indices, idx)
+	}
+	slices.Sort(indices)
+
+	for _, idx := range indices {
+		if n := len(lc.cfg.Accounts); idx > n+1 {
+			return fmt.Errorf(
+				"account #%d is given in the environment, but account #%d is neither there nor in any config file",
+				idx,
+				n+1,
+			)
+		} else if idx == n+1 {
+			lc.cfg.Accounts = append(lc.cfg.Accounts, &AccountConfig{})
+		}
+		mergeFields(
+			reflect.ValueOf(lc.cfg.Accounts[idx-1]).Elem(),
+			reflect.ValueOf(overrides[idx]).Elem(),
+			fmt.Sprintf("accounts[%d]", idx-1),
+			func(key string) string { return "env " + envKey(idx, strings.ToUpper(key)) },
+			lc.sources,
+		)
+	}
+
+	if s := os.Getenv(envNumAccounts); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad %s '%s'", envNumAccounts, s)
+		}
+		if len(lc.cfg.Accounts) != n {
+			return fmt.Errorf("%s is %d, but %d account(s) are configured", envNumAccounts, n, len(lc.cfg.Accounts))
+		}
+	}
+
+	return nil
+}
+
+// isEnvSettable returns whether config fields of type t can be given in
+// environment variables, list ones being comma-separated.
+func isEnvSettable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	default:
+		return false
+	}
+}
+
+// setFieldFromEnv sets the field with the given config key from the value of
+// an environment variable, returning false if there is no such field.
+func setFieldFromEnv(x any, key string, val string) bool {
+	v := reflect.ValueOf(x).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := configFieldName(t.Field(i))
+		if !ok || name != key || !isEnvSettable(t.Field(i).Type) {
+			continue
+		}
+
+		if t.Field(i).Type.Kind() == reflect.String {
+			v.Field(i).SetString(val)
+			return true
+		}
+
+		var items []string
+		for item := range strings.SplitSeq(val, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		v.Field(i).Set(reflect.ValueOf(items))
+		return true
+	}
+	return false
+}
+
+// mergeFields copies the non-zero config fields of src over dst, both being
+// addressable values of the same struct type, recording the sources.
+func mergeFields(
+	dst reflect.Value,
+	src reflect.Value,
+	prefix string,
+	sourceOf func(key string) string,
+	sources map[string]string,
+) {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key, ok := configFieldName(t.Field(i))
+		if !ok || src.Field(i).IsZero() {
+			continue
+		}
+
+		dst.Field(i).Set(src.Field(i))
+		sources[joinConfigPath(prefix, key)] = sourceOf(key)
+	}
+}
+
+// finish resolves and validates the merged config, and returns it.
+func (lc *layeredConfig) finish() (*Config, error) {
+	for i, acc := range lc.cfg.Accounts {
+		err := acc.postinit(i + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, nc := range lc.cfg.Notifications {
+		err := nc.postinit()
+		if err != nil {
+			return nil, fmt.Errorf("notification channel #%d: %w", i+1, err)
+		}
+	}
+	return &lc.cfg, nil
+}
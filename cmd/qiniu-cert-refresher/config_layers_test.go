@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLayeredConfigMerge(t *testing.T) {
+	testcases := []struct {
+		name  string
+		files []string
+		env   map[string]string
+		// want lists the merged accounts as "ak/display name/prefix"
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "same AK twice in one file",
+			files: []string{`
+[[accounts]]
+ak = "AK1"
+managed_cert_name_prefix = "team-a"
+
+[[accounts]]
+ak = "AK1"
+managed_cert_name_prefix = "team-b"
+`},
+			want: []string{"AK1//team-a", "AK1//team-b"},
+		},
+		{
+			name: "override by AK",
+			files: []string{`
+[[accounts]]
+ak = "AK1"
+managed_cert_name_prefix = "old"
+
+[[accounts]]
+ak = "AK2"
+`, `
+[[accounts]]
+ak = "AK1"
+managed_cert_name_prefix = "new"
+`},
+			want: []string{"AK1//new", "AK2//"},
+		},
+		{
+			name: "override by display name",
+			files: []string{`
+[[accounts]]
+display_name = "prod"
+ak = "AK1"
+`, `
+[[accounts]]
+display_name = "prod"
+managed_cert_name_prefix = "p"
+`},
+			want: []string{"AK1/prod/p"},
+		},
+		{
+			name: "named account not overridden by AK",
+			files: []string{`
+[[accounts]]
+display_name = "prod"
+ak = "AK1"
+`, `
+[[accounts]]
+ak = "AK1"
+`},
+			want: []string{"AK1/prod/", "AK1//"},
+		},
+		{
+			name: "each earlier account overridden at most once",
+			files: []string{`
+[[accounts]]
+ak = "AK1"
+`, `
+[[accounts]]
+ak = "AK1"
+managed_cert_name_prefix = "a"
+
+[[accounts]]
+ak = "AK1"
+managed_cert_name_prefix = "b"
+`},
+			want: []string{"AK1//a", "AK1//b"},
+		},
+		{
+			name: "env adds and overrides accounts",
+			files: []string{`
+[[accounts]]
+ak = "AK1"
+`},
+			env: map[string]string{
+				"QCR_ACCOUNT_1_MANAGED_CERT_NAME_PREFIX": "p1",
+				"QCR_ACCOUNT_2_AK":                       "AK2",
+				envNumAccounts:                           "2",
+			},
+			want: []string{"AK1//p1", "AK2//"},
+		},
+		{
+			name:    "env account numbering gap",
+			files:   []string{"[[accounts]]\nak = \"AK1\"\n"},
+			env:     map[string]string{"QCR_ACCOUNT_3_AK": "AK3"},
+			wantErr: "account #2 is neither there",
+		},
+		{
+			name:    "account count mismatch",
+			files:   []string{"[[accounts]]\nak = \"AK1\"\n"},
+			env:     map[string]string{envNumAccounts: "2"},
+			wantErr: "QCR_NUM_ACCOUNTS is 2, but 1 account(s) are configured",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(envNumAccounts, "")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			dir := t.TempDir()
+			lc := newLayeredConfig()
+			var err error
+			for i, content := range tc.files {
+				path := filepath.Join(dir, fmt.Sprintf("%d.toml", i))
+				err = os.WriteFile(path, []byte(content), 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = lc.mergeFile(path, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = lc.mergeEnv()
+
+			if len(tc.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, len(lc.cfg.Accounts))
+			for i, acc := range lc.cfg.Accounts {
+				got[i] = acc.AK + "/" + acc.DisplayName + "/" + acc.ManagedCertNamePrefix
+			}
+			if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+				t.Errorf("accounts = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// journalEvent is the kind of a rotation journal record.
+type journalEvent string
+
+const (
+	// journalBegin starts the journal of a rotation, or with an account,
+	// the processing of the account
+	journalBegin journalEvent = "begin"
+	// journalUploaded records the new cert uploaded to an account
+	journalUploaded journalEvent = "uploaded"
+	// journalPlanned records a domain update about to be made
+	journalPlanned journalEvent = "planned"
+	// journalDone records a domain update that's made, or found unnecessary,
+	// or without a domain, an account with all its domain updates planned
+	journalDone journalEvent = "done"
+	// journalFailed records a failed domain update, which is to be retried
+	journalFailed journalEvent = "failed"
+	// journalSkipped records a domain update given up, because the domain has
+	// been changed by someone else in the meantime
+	journalSkipped journalEvent = "skipped"
+	// journalComplete marks the journal as having nothing left to do
+	journalComplete journalEvent = "complete"
+)
+
+type journalRecord struct {
+	Time       time.Time    `json:"time"`
+	Event      journalEvent `json:"event"`
+	Command    string       `json:"command,omitempty"`
+	TracingKey string       `json:"tracingKey,omitempty"`
+	Account    string       `json:"account,omitempty"`
+	AK         string       `json:"ak,omitempty"`
+	Domain     string       `json:"domain,omitempty"`
+	OldCertID  string       `json:"oldCertID,omitempty"`
+	NewCertID  string       `json:"newCertID,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// rotationJournal is an append-only JSON lines file recording the progress
+// of one rotation, so an interrupted one can be resumed. It is safe for
+// concurrent use.
+type rotationJournal struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+var unsafeFileNameCharsRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// errJournalLocked means the journal is being written by another process,
+// i.e. the rotation is still in progress.
+var errJournalLocked = errors.New("the journal is in use by another process")
+
+const (
+	// journalArchiveDir is where complete journals are moved, relative to
+	// the journal dir, so they are no longer considered for resuming
+	journalArchiveDir = "archive"
+	// journalArchiveRetention is how long archived journals are kept
+	journalArchiveRetention = 90 * 24 * time.Hour
+)
+
+// createRotationJournal starts a new journal in dir for rotating the given
+// tracing key with the named command.
+func createRotationJournal(dir string, command string, key string) (*rotationJournal, error) {
+	prefix := fmt.Sprintf(
+		"%s-%s-",
+		time.Now().UTC().Format("20060102T150405Z"),
+		unsafeFileNameCharsRE.ReplaceAllString(key, "_"),
+	)
+	f, err := os.CreateTemp(dir, prefix+"*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	err = lockJournalFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	j := &rotationJournal{path: f.Name(), f: f}
+	err = j.append(&journalRecord{Event: journalBegin, Command: command, TracingKey: key})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// openRotationJournal opens an existing journal for appending, returning its
+// records so far. errJournalLocked is returned if another process is still
+// writing the journal.
+func openRotationJournal(path string) (*rotationJournal, []*journalRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = lockJournalFile(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	records, err := readJournalRecords(path)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	// terminate any torn last line, lest it swallow the next record
+	err = terminateLastLine(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &rotationJournal{path: path, f: f}, records, nil
+}
+
+func readJournalRecords(path string) ([]*journalRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []*journalRecord
+	sc := bufio.NewScanner(f)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		var r journalRecord
+		err := json.Unmarshal(sc.Bytes(), &r)
+		if err != nil {
+			// the last line may be torn if we died while writing it
+			slog.Warn("skipping malformed journal record", "path", path, "line", lineno, "err", err)
+			continue
+		}
+		result = append(result, &r)
+	}
+	return result, sc.Err()
+}
+
+// append durably writes r to the journal.
+func (j *rotationJournal) append(r *journalRecord) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, err = j.f.Write(line)
+	if err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *rotationJournal) Close() error {
+	return j.f.Close()
+}
+
+// complete marks the journal as having nothing left to do, and archives it.
+func (j *rotationJournal) complete() error {
+	err := j.append(&journalRecord{Event: journalComplete})
+	if err != nil {
+		return err
+	}
+	archiveJournal(j.path)
+	return nil
+}
+
+// archiveJournal moves the complete journal at path out of the way of
+// resume, only logging failures to do so.
+func archiveJournal(path string) {
+	dir := filepath.Join(filepath.Dir(path), journalArchiveDir)
+	err := os.MkdirAll(dir, 0o700)
+	if err == nil {
+		err = os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+	}
+	if err != nil {
+		slog.Warn("failed to archive the complete journal", "path", path, "err", err)
+	}
+}
+
+// pruneJournalArchive removes the archived journals in journalDir older than
+// journalArchiveRetention.
+func pruneJournalArchive(journalDir string, now time.Time) {
+	paths, err := filepath.Glob(filepath.Join(journalDir, journalArchiveDir, "*.jsonl"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil || now.Sub(fi.ModTime()) < journalArchiveRetention {
+			continue
+		}
+		slog.Debug("pruning archived journal", "path", path)
+		err = os.Remove(path)
+		if err != nil {
+			slog.Warn("failed to prune archived journal", "path", path, "err", err)
+		}
+	}
+}
+
+// accountJournal writes journal records on behalf of one account. A nil
+// *accountJournal writes nothing.
+type accountJournal struct {
+	j   *rotationJournal
+	acc *AccountConfig
+}
+
+func (j *rotationJournal) forAccount(acc *AccountConfig) *accountJournal {
+	if j == nil {
+		return nil
+	}
+	return &accountJournal{j: j, acc: acc}
+}
+
+// record writes a domain-level record, only logging failures to do so, as
+// the journal is a safety net that shouldn't stop the rotation itself.
+func (aj *accountJournal) record(
+	event journalEvent,
+	domain string,
+	oldCertID string,
+	newCertID string,
+	cause error,
+) {
+	if aj == nil {
+		return
+	}
+
+	r := journalRecord{
+		Event:     event,
+		Account:   aj.acc.DisplayName,
+		AK:        aj.acc.AK,
+		Domain:    domain,
+		OldCertID: oldCertID,
+		NewCertID: newCertID,
+	}
+	if cause != nil {
+		r.Error = cause.Error()
+	}
+
+	err := aj.j.append(&r)
+	if err != nil {
+		slog.Warn("failed to write the rotation journal", "path", aj.j.path, "err", err)
+	}
+}
+
+// recordAccount writes an account-level record.
+func (aj *accountJournal) recordAccount(event journalEvent, newCertID string) {
+	aj.record(event, "", "", newCertID, nil)
+}
+
+// outstandingAccounts returns the accounts in records that are begun but not
+// done, i.e. failed as a whole before planning all their domain updates, in
+// the order they were begun. The records returned carry the ID of the cert
+// uploaded to the account, if any.
+func outstandingAccounts(records []*journalRecord) []*journalRecord {
+	pending := make(map[string]*journalRecord)
+	var order []string
+	for _, r := range records {
+		if len(r.AK) == 0 || len(r.Domain) > 0 {
+			continue
+		}
+		switch r.Event {
+		case journalBegin:
+			if _, ok := pending[r.AK]; !ok {
+				order = append(order, r.AK)
+			}
+			pending[r.AK] = r
+		case journalUploaded:
+			pending[r.AK] = r
+		case journalDone:
+			delete(pending, r.AK)
+		}
+	}
+
+	var result []*journalRecord
+	for _, ak := range order {
+		if r, ok := pending[ak]; ok {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// outstandingUpdates returns the planned domain updates in records that are
+// neither done nor given up, in the order they were planned.
+func outstandingUpdates(records []*journalRecord) []*journalRecord {
+	type updateKey struct{ ak, domain string }
+
+	pending := make(map[updateKey]*journalRecord)
+	var order []updateKey
+	for _, r := range records {
+		if len(r.Domain) == 0 {
+			continue
+		}
+		k := updateKey{r.AK, r.Domain}
+		switch r.Event {
+		case journalPlanned:
+			if _, ok := pending[k]; !ok {
+				order = append(order, k)
+			}
+			pending[k] = r
+		case journalDone, journalSkipped:
+			delete(pending, k)
+		}
+	}
+
+	var result []*journalRecord
+	for _, k := range order {
+		if r, ok := pending[k]; ok {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func isJournalComplete(records []*journalRecord) bool {
+	return slices.ContainsFunc(records, func(r *journalRecord) bool { return r.Event == journalComplete })
+}
@@ -0,0 +1,22 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockJournalFile takes an exclusive lock on the open journal file, which is
+// released when the file is closed, failing with errJournalLocked instead of
+// waiting if another process holds it.
+func lockJournalFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errJournalLocked
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// lockJournalFile does nothing on this platform, where journals are not
+// protected against concurrent resumption.
+func lockJournalFile(f *os.File) error {
+	return nil
+}
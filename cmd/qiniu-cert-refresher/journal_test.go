@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotationJournalLocking(t *testing.T) {
+	dir := t.TempDir()
+	j, err := createRotationJournal(dir, "upload", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// held by the rotation in progress
+	_, _, err = openRotationJournal(j.path)
+	if !errors.Is(err, errJournalLocked) {
+		t.Fatalf("err = %v, want errJournalLocked", err)
+	}
+	reports, resumed, err := resumeJournal(t.Context(), &Config{}, j.path)
+	if err != nil || resumed || len(reports) > 0 {
+		t.Errorf("resumed a journal in use: %v, %v, %v", reports, resumed, err)
+	}
+
+	j.Close()
+	j2, records, err := openRotationJournal(j.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j2.Close()
+	if len(records) != 1 || records[0].Command != "upload" || records[0].TracingKey != "example.com" {
+		t.Errorf("unexpected records %v", records)
+	}
+}
+
+func TestRotationJournalArchiving(t *testing.T) {
+	dir := t.TempDir()
+	j, err := createRotationJournal(dir, "refresh", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	err = j.complete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived := filepath.Join(dir, journalArchiveDir, filepath.Base(j.path))
+	if _, err := os.Stat(archived); err != nil {
+		t.Fatalf("complete journal not archived: %v", err)
+	}
+	if _, err := os.Stat(j.path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("complete journal left in place: %v", err)
+	}
+
+	// kept until the retention is over
+	pruneJournalArchive(dir, time.Now())
+	if _, err := os.Stat(archived); err != nil {
+		t.Fatalf("archived journal pruned too early: %v", err)
+	}
+	pruneJournalArchive(dir, time.Now().Add(journalArchiveRetention+time.Hour))
+	if _, err := os.Stat(archived); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("archived journal not pruned: %v", err)
+	}
+}
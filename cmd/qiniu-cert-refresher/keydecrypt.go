@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des" //nolint:gosec // legacy OpenSSL/PBES2 keys must be readable
+	"crypto/pbkdf2"
+	"crypto/sha1" //nolint:gosec // legacy OpenSSL/PBES2 keys must be readable
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// This implements just enough of PKCS#5 v2 (RFC 8018) to decrypt the PKCS#8
+// keys produced by OpenSSL and friends, i.e. PBES2 with PBKDF2, as the
+// standard library has no support for it.
+
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+)
+
+var pbkdf2PRFs = map[string]func() hash.Hash{
+	"1.2.840.113549.2.7":  sha1.New,
+	"1.2.840.113549.2.8":  sha256.New224,
+	"1.2.840.113549.2.9":  sha256.New,
+	"1.2.840.113549.2.10": sha512.New384,
+	"1.2.840.113549.2.11": sha512.New,
+}
+
+type pbes2Cipher struct {
+	keyLen   int
+	newBlock func(key []byte) (cipher.Block, error)
+}
+
+var pbes2Ciphers = map[string]pbes2Cipher{
+	"2.16.840.1.101.3.4.1.2":  {16, aes.NewCipher},
+	"2.16.840.1.101.3.4.1.22": {24, aes.NewCipher},
+	"2.16.840.1.101.3.4.1.42": {32, aes.NewCipher},
+	"1.2.840.113549.3.7":      {24, des.NewTripleDESCipher},
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// isEncryptedPKCS8 returns whether der looks like an EncryptedPrivateKeyInfo.
+func isEncryptedPKCS8(der []byte) bool {
+	var info encryptedPrivateKeyInfo
+	rest, err := asn1.Unmarshal(der, &info)
+	return err == nil && len(rest) == 0 && len(info.EncryptedData) > 0
+}
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo, returning the DER of the
+// contained PrivateKeyInfo.
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted private key: %w", err)
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %s, only PBES2 is supported", info.Algo.Algorithm)
+	}
+
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PBES2 parameters: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf(
+			"unsupported key derivation function %s, only PBKDF2 is supported",
+			params.KeyDerivationFunc.Algorithm,
+		)
+	}
+
+	var kdfParams pbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PBKDF2 parameters: %w", err)
+	}
+
+	prf := sha1.New // the default per RFC 8018
+	if len(kdfParams.PRF.Algorithm) > 0 {
+		var ok bool
+		prf, ok = pbkdf2PRFs[kdfParams.PRF.Algorithm.String()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported PBKDF2 PRF %s", kdfParams.PRF.Algorithm)
+		}
+	}
+
+	c, ok := pbes2Ciphers[params.EncryptionScheme.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key cipher %s", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cipher parameters: %w", err)
+	}
+
+	key, err := pbkdf2.Key(prf, string(passphrase), kdfParams.Salt, kdfParams.IterationCount, c.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := c.newBlock(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := info.EncryptedData
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted private key")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	plain, err = unpadPKCS7(plain, block.BlockSize())
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return plain, nil
+}
+
+var errWrongPassphrase = errors.New("wrong passphrase for the private key")
+
+func unpadPKCS7(data []byte, blockSize int) ([]byte, error) {
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, errors.New("bad padding")
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, errors.New("bad padding")
+		}
+	}
+	return data[:len(data)-n], nil
+}
+
+// decryptPrivateKeyPEMBlock decrypts an encrypted PEM block, be it a PKCS#8
+// "ENCRYPTED PRIVATE KEY" or a legacy OpenSSL one with the Proc-Type and
+// DEK-Info headers, returning the DER of the key.
+func decryptPrivateKeyPEMBlock(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return decryptPKCS8(block.Bytes, passphrase)
+	}
+
+	// the legacy encryption is insecure and thus deprecated, but it's what
+	// we're given
+	der, err := x509.DecryptPEMBlock(block, passphrase) //nolint:staticcheck // legacy OpenSSL keys must be readable
+	if err != nil {
+		if errors.Is(err, x509.IncorrectPasswordError) { //nolint:staticcheck // ditto
+			return nil, errWrongPassphrase
+		}
+		return nil, err
+	}
+	return der, nil
+}
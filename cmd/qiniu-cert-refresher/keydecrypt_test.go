@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures are made from key-plain.pem with the passphrase below, like:
+//
+//	openssl pkcs8 -topk8 -v2 aes-256-cbc -in key-plain.pem -out key-pbes2-aes256.pem
+//	openssl pkcs8 -topk8 -v2 des3 -v2prf hmacWithSHA1 -in key-plain.pem -out key-pbes2-des3.pem
+//	openssl ec -aes128 -in key-plain.pem -out key-legacy-aes128.pem
+const testKeyPassphrase = "correct-horse"
+
+func readTestKey(t *testing.T, name string, passphrase func() ([]byte, error)) (*ecdsa.PrivateKey, error) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := parsePrivateKeyPEMOrDER(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		t.Fatalf("unexpected key type %T", key)
+	}
+	return ecKey, nil
+}
+
+func staticPassphrase(s string) func() ([]byte, error) {
+	return func() ([]byte, error) { return []byte(s), nil }
+}
+
+func TestDecryptPrivateKey(t *testing.T) {
+	want, err := readTestKey(t, "key-plain.pem", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		"key-pbes2-aes256.pem",
+		"key-pbes2-des3.pem",
+		"key-legacy-aes128.pem",
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := readTestKey(t, name, staticPassphrase(testKeyPassphrase))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(want) {
+				t.Error("decrypted key differs from the original")
+			}
+
+			_, err = readTestKey(t, name, staticPassphrase("wrong"))
+			if !errors.Is(err, errWrongPassphrase) {
+				t.Errorf("err = %v with a wrong passphrase, want errWrongPassphrase", err)
+			}
+
+			_, err = readTestKey(t, name, nil)
+			if !errors.Is(err, errEncryptedKey) {
+				t.Errorf("err = %v without a passphrase, want errEncryptedKey", err)
+			}
+		})
+	}
+}
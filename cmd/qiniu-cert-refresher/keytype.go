@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+// certKeyType is the type of the key of a cert, so that an RSA and an ECDSA
+// cert can be kept side by side under the same tracing key. The empty value
+// means unknown, as is the case with certs uploaded by older versions.
+type certKeyType string
+
+const (
+	certKeyTypeRSA   certKeyType = "rsa"
+	certKeyTypeECDSA certKeyType = "ecdsa"
+)
+
+var certKeyTypes = []certKeyType{certKeyTypeRSA, certKeyTypeECDSA}
+
+func (t certKeyType) String() string {
+	if t == "" {
+		return "(unknown)"
+	}
+	return string(t)
+}
+
+func parseCertKeyType(s string) (certKeyType, error) {
+	for _, t := range certKeyTypes {
+		if strings.EqualFold(s, string(t)) {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown key type '%s', expected 'rsa' or 'ecdsa'", s)
+}
+
+func keyTypeOfPublicKey(pub crypto.PublicKey) (certKeyType, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return certKeyTypeRSA, nil
+	case *ecdsa.PublicKey:
+		return certKeyTypeECDSA, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+func keyTypeOfManagedCert(acc *AccountConfig, c *qcdn.Cert) certKeyType {
+	_, kt, _ := acc.tracingKeyOfCert(c)
+	return kt
+}
+
+func filterCertsByKeyType(acc *AccountConfig, certs []*qcdn.Cert, kt certKeyType) []*qcdn.Cert {
+	var result []*qcdn.Cert
+	for _, c := range certs {
+		if keyTypeOfManagedCert(acc, c) == kt {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// preferredKeyType returns the key type of certs the domain should use,
+// either as given by the first matching HTTPS policy or for the account as a
+// whole, or the empty value if there is no preference.
+func (x *AccountConfig) preferredKeyType(domain string) certKeyType {
+	if p := findHTTPSPolicy(x, domain); p != nil && len(p.KeyType) > 0 {
+		return certKeyType(p.KeyType)
+	}
+	return certKeyType(x.KeyType)
+}
+
+// shouldRebind returns whether the domain, currently using a cert of key type
+// cur, should be switched to a new cert of key type next. Without a
+// preference, domains keep the key type they are using; domains on certs of
+// unknown key type follow whatever is uploaded.
+func (x *AccountConfig) shouldRebind(domain string, cur certKeyType, next certKeyType) bool {
+	if pref := x.preferredKeyType(domain); len(pref) > 0 {
+		return pref == next
+	}
+	return cur == "" || cur == next
+}
@@ -5,10 +5,16 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"time"
 
 	"github.com/urfave/cli/v2"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+	"github.com/xen0n/qiniu-cert-refresher/api/qiniucommon"
 )
 
 func main() {
@@ -19,7 +25,9 @@ func main() {
 			&cli.PathFlag{
 				Name:    "config",
 				Aliases: []string{"c"},
-				Usage:   "force using configuration from this file (supported format: toml)",
+				Usage: "use configuration from this file instead of ./" + defaultConfigPath +
+					", on top of the system and user ones " +
+					"(supported formats: toml, yaml, json; selected by extension)",
 			},
 			&cli.BoolFlag{
 				Name:    "debug",
@@ -29,7 +37,24 @@ func main() {
 			&cli.BoolFlag{
 				Name:    "env-config",
 				Aliases: []string{"e"},
-				Usage:   "force using configuration from environment variables",
+				Usage:   "only use configuration from environment variables, ignoring all config files",
+			},
+			&cli.PathFlag{
+				Name:  "state-dir",
+				Usage: "keep local state like rotation journals in this directory (default: $XDG_STATE_HOME/qcr)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "account",
+				Aliases: []string{"a"},
+				Usage:   "only operate on the account with this display name (can be repeated)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "account-tag",
+				Usage: "only operate on accounts with this tag (can be repeated)",
+			},
+			&cli.BoolFlag{
+				Name:  "trace-http-bodies",
+				Usage: "include HTTP bodies in debug output, with secrets masked",
 			},
 			&cli.BoolFlag{
 				Name:    "jsonlog",
@@ -45,6 +70,350 @@ func main() {
 				Before:  beforeCmd,
 				Action:  cmdInfo,
 			},
+			{
+				Name:      "adopt",
+				Usage:     "adopts existing certificates not uploaded by this tool, to be superseded by later uploads",
+				ArgsUsage: "<TRACING-KEY>",
+				Before:    beforeCmd,
+				Action:    cmdAdopt,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "cert-id",
+						Usage: "adopt the certificate with this ID",
+					},
+					&cli.StringSliceFlag{
+						Name:  "match",
+						Usage: "adopt certificates whose CN or any SAN matches this glob pattern, like '*.example.com'",
+					},
+					&cli.BoolFlag{
+						Name:  "forget",
+						Usage: "undo the adoption instead, of all certificates of the tracing key if none is selected",
+					},
+				},
+			},
+			{
+				Name:  "audit",
+				Usage: "works with the audit log",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "verify",
+						Usage:     "checks the audit log for tampering",
+						ArgsUsage: "[AUDIT-LOG-FILE]",
+						Before:    beforeCmdWithoutConfig,
+						Action:    cmdAuditVerify,
+					},
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "inspects the configuration",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "check",
+						Usage:  "validates the configuration and reports all problems found",
+						Before: beforeCmdWithoutConfig,
+						Action: cmdConfigCheck,
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "verify",
+								Usage: "also verify the credentials with a read-only API call",
+							},
+						},
+					},
+					{
+						Name:   "show",
+						Usage:  "shows where the configuration is loaded from",
+						Before: beforeCmdWithoutConfig,
+						Action: cmdConfigShow,
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name: "effective",
+								Usage: "show the merged configuration, with secrets masked, " +
+									"and where each value came from",
+							},
+						},
+					},
+					{
+						Name:   "schema",
+						Usage:  "prints the JSON Schema of the configuration file, for editor validation",
+						Action: cmdConfigSchema,
+					},
+				},
+			},
+			{
+				Name:    "domain",
+				Aliases: []string{"d"},
+				Usage:   "manages CDN domains of the configured account",
+				Subcommands: []*cli.Command{
+					{
+						Name:    "list",
+						Aliases: []string{"ls"},
+						Usage:   "lists domains of all configured accounts",
+						Before:  beforeCmd,
+						Action:  cmdDomainList,
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:  "type",
+								Usage: "only list domains of this type (normal, wildcard, pan, test; can be repeated)",
+							},
+							&cli.StringFlag{
+								Name:  "cert-id",
+								Usage: "only list domains using this certificate",
+							},
+							&cli.StringSliceFlag{
+								Name: "source-type",
+								Usage: "only list domains with this origin type " +
+									"(domain, ip, qiniuBucket, advanced; can be repeated)",
+							},
+							&cli.StringFlag{
+								Name: "source-bucket",
+								Usage: "only list domains backed by this Qiniu bucket " +
+									"(requires --source-type qiniuBucket)",
+							},
+							&cli.StringFlag{
+								Name:  "source-ip",
+								Usage: "only list domains backed by this origin IP (requires --source-type ip)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "name",
+								Usage: "only list domains matching this glob (can be repeated)",
+							},
+							&cli.BoolFlag{
+								Name:  "https-only",
+								Usage: "only list domains with HTTPS enabled",
+							},
+							&cli.StringSliceFlag{
+								Name:  "tag",
+								Usage: "only list domains having this tag (can be repeated, all must match)",
+							},
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "output format (table, json)",
+								Value: "table",
+							},
+							&cli.IntFlag{
+								Name:  "page-size",
+								Usage: "number of domains to fetch per API call (1-1000)",
+								Value: 100,
+							},
+						},
+					},
+					{
+						Name:      "show",
+						Usage:     "shows the full configuration of domains",
+						ArgsUsage: "<DOMAIN>...",
+						Before:    beforeCmd,
+						Action:    cmdDomainShow,
+					},
+					{
+						Name:      "create",
+						Usage:     "creates a new domain, optionally with HTTPS enabled",
+						ArgsUsage: "<DOMAIN>",
+						Before:    beforeCmd,
+						Action:    cmdDomainCreate,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "type",
+								Usage: "domain type (normal, wildcard, pan)",
+								Value: string(qcdn.DomainTypeNormal),
+							},
+							&cli.StringFlag{
+								Name:  "platform",
+								Usage: "platform type (web, download, vod)",
+								Value: "web",
+							},
+							&cli.StringFlag{
+								Name:  "geo-cover",
+								Usage: "geographical coverage (china, foreign, global)",
+								Value: "china",
+							},
+							&cli.StringFlag{
+								Name:  "parent-domain",
+								Usage: "parent wildcard domain, required for domains of type 'pan'",
+							},
+							&cli.BoolFlag{
+								Name:  "ipv6",
+								Usage: "enable IPv6 in addition to IPv4",
+							},
+							&cli.StringFlag{
+								Name:  "source-type",
+								Usage: "origin type (domain, ip, qiniuBucket)",
+								Value: string(qcdn.SourceTypeDomain),
+							},
+							&cli.StringFlag{
+								Name:  "source-domain",
+								Usage: "origin domain, for source type 'domain'",
+							},
+							&cli.StringSliceFlag{
+								Name:  "source-ip",
+								Usage: "origin IP, for source type 'ip' (can be repeated)",
+							},
+							&cli.StringFlag{
+								Name:  "source-bucket",
+								Usage: "origin Qiniu bucket, for source type 'qiniuBucket'",
+							},
+							&cli.StringFlag{
+								Name:  "source-host",
+								Usage: "Host header to use when fetching from the origin",
+							},
+							&cli.StringFlag{
+								Name: "source-scheme",
+								Usage: "scheme to use when fetching from the origin " +
+									"(http, https, empty to follow the request)",
+							},
+							&cli.StringFlag{
+								Name:  "test-url-path",
+								Usage: "path of an always-accessible resource on the origin",
+							},
+							&cli.StringFlag{
+								Name:  "cert-id",
+								Usage: "enable HTTPS with this certificate",
+							},
+							&cli.StringFlag{
+								Name:  "tracing-key",
+								Usage: "enable HTTPS with the latest valid managed certificate of this tracing key",
+							},
+							&cli.BoolFlag{
+								Name:  "force-https",
+								Usage: "redirect HTTP requests to HTTPS",
+							},
+							&cli.BoolFlag{
+								Name:  "http2",
+								Usage: "enable HTTP/2",
+							},
+						},
+					},
+					{
+						Name:      "online",
+						Usage:     "brings offlined domains back online",
+						ArgsUsage: "<DOMAIN>...",
+						Before:    beforeCmd,
+						Action:    cmdDomainOnline,
+					},
+					{
+						Name:      "offline",
+						Usage:     "takes domains offline",
+						ArgsUsage: "<DOMAIN>...",
+						Before:    beforeCmd,
+						Action:    cmdDomainOffline,
+					},
+					{
+						Name:      "delete",
+						Usage:     "deletes domains, which must have been taken offline first",
+						ArgsUsage: "<DOMAIN>...",
+						Before:    beforeCmd,
+						Action:    cmdDomainDelete,
+					},
+				},
+			},
+			{
+				Name:   "inventory",
+				Usage:  "lists all certs across accounts, reporting duplicates, unused and expired ones",
+				Before: beforeCmd,
+				Action: cmdInventory,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Value: "table",
+						Usage: "output format, one of 'table', 'csv' and 'json'",
+					},
+					&cli.PathFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "write the report to this file instead of stdout",
+					},
+					&cli.BoolFlag{
+						Name: "fetch-certs",
+						Usage: "fetch every cert to identify duplicates by fingerprint, " +
+							"instead of by names and validity " +
+							"(the API returns the private keys along, which are masked in HTTP traces and not kept)",
+					},
+					&cli.IntFlag{
+						Name:  "cert-quota",
+						Usage: "the number of certs each account may hold, 0 for unknown",
+					},
+					&cli.Float64Flag{
+						Name:  "quota-warning",
+						Value: 0.8,
+						Usage: "warn about accounts holding at least this fraction of the cert quota",
+					},
+				},
+			},
+			{
+				Name:   "notify-expiring",
+				Usage:  "warns about certs of live domains expiring soon, meant to be run periodically",
+				Before: beforeCmd,
+				Action: cmdNotifyExpiring,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "days",
+						Value: 30,
+						Usage: "warn about certs expiring within this many days",
+					},
+					&cli.DurationFlag{
+						Name:  "repeat-after",
+						Value: 24 * time.Hour,
+						Usage: "warn about the same cert again only after this long",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "print what would be sent instead of sending it",
+					},
+				},
+			},
+			{
+				Name:   "notify-test",
+				Usage:  "sends a test rotation notification with the configured channels",
+				Before: beforeCmd,
+				Action: cmdNotifyTest,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "channel",
+						Usage: "only use the channel with this name, or type if unnamed (can be repeated)",
+					},
+					&cli.BoolFlag{
+						Name:  "failure",
+						Usage: "pretend the rotation failed",
+					},
+				},
+			},
+			{
+				Name:   "reconcile",
+				Usage:  "detects and corrects drift of domains' HTTPS config from the declared policies",
+				Before: beforeCmd,
+				Action: cmdReconcile,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "apply",
+						Usage: "actually make the changes instead of only showing the plan",
+					},
+				},
+			},
+			{
+				Name:      "refresh",
+				Usage:     "binds the domains of a tracing key to its latest valid certificates, without uploading",
+				ArgsUsage: "<TRACING-KEY>",
+				Before:    beforeCmd,
+				Action:    cmdRefresh,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "parallelism",
+						Value: 4,
+						Usage: "process at most this many accounts at the same time",
+					},
+					&cli.BoolFlag{
+						Name:  "fail-fast",
+						Usage: "process accounts one by one, stopping at the first failure",
+					},
+				},
+			},
+			{
+				Name:      "resume",
+				Usage:     "finishes interrupted or partially failed rotations recorded in journals",
+				ArgsUsage: "[JOURNAL-FILE...]",
+				Before:    beforeCmd,
+				Action:    cmdResume,
+			},
 			{
 				Name:      "upload",
 				Aliases:   []string{"u"},
@@ -54,12 +423,48 @@ func main() {
 				Action:    cmdUpload,
 				Flags: []cli.Flag{
 					&cli.PathFlag{
-						Name:  "cert",
-						Usage: "path to the certificate file",
+						Name: "cert",
+						Usage: "path to the certificate chain file, " +
+							"in PEM (optionally bundled with the private key), DER or PKCS#12 format",
+					},
+					&cli.PathFlag{
+						Name: "pem",
+						Usage: "path to the private key file, in PEM or DER format; " +
+							"not needed if bundled with the certificate",
+					},
+					&cli.PathFlag{
+						Name:  "p12-password-file",
+						Usage: "read the password of the PKCS#12 certificate file from this file",
 					},
 					&cli.PathFlag{
-						Name:  "pem",
-						Usage: "path to the private key file",
+						Name:  "pem-passphrase-file",
+						Usage: "read the passphrase of the encrypted private key from this file",
+					},
+					&cli.StringFlag{
+						Name:  "pem-passphrase-env",
+						Usage: "take the passphrase of the encrypted private key from this environment variable",
+					},
+					&cli.StringFlag{
+						Name:  "pem-passphrase-command",
+						Usage: "take the passphrase of the encrypted private key from the output of this shell command",
+					},
+					&cli.PathFlag{
+						Name: "intermediates-dir",
+						Usage: "complete the certificate chain with the intermediates in this directory " +
+							"(overrides the config)",
+					},
+					&cli.BoolFlag{
+						Name:  "fetch-aia",
+						Usage: "complete the certificate chain by fetching issuers via AIA (overrides the config)",
+					},
+					&cli.IntFlag{
+						Name:  "parallelism",
+						Value: 4,
+						Usage: "process at most this many accounts at the same time",
+					},
+					&cli.BoolFlag{
+						Name:  "fail-fast",
+						Usage: "process accounts one by one, stopping at the first failure",
 					},
 				},
 			},
@@ -78,6 +483,13 @@ func beforeCmd(cCtx *cli.Context) error {
 	return initConfig(cCtx)
 }
 
+// beforeCmdWithoutConfig is for commands dealing with the configuration
+// themselves, that must not fail on a broken one.
+func beforeCmdWithoutConfig(cCtx *cli.Context) error {
+	initLogging(cCtx)
+	return nil
+}
+
 func initLogging(cCtx *cli.Context) {
 	var opts slog.HandlerOptions
 
@@ -96,52 +508,67 @@ func initLogging(cCtx *cli.Context) {
 	}
 
 	slog.SetDefault(slog.New(h))
+	qiniucommon.SetTraceBodies(cCtx.Bool("trace-http-bodies"))
 }
 
+// commandsRequiringAdoptions are the commands that rotate certs, and thus
+// must not proceed without knowing the adopted certs.
+var commandsRequiringAdoptions = []string{"refresh", "resume", "upload"}
+
 func initConfig(cCtx *cli.Context) error {
-	forceEnv := cCtx.Bool("env-config")
-	forceFilePath := cCtx.Path("config")
-	forceFile := len(forceFilePath) > 0
-	if forceEnv && forceFile {
-		return errors.New("cannot force configuration from both environment and file")
+	lc, err := loadConfigLayers(cCtx)
+	if err != nil {
+		return err
 	}
 
-	var cfg *Config
-	if forceEnv {
-		var err error
-		slog.Debug("forced configuration from environment")
-		cfg, err = configFromEnv()
-		if err != nil {
-			return err
-		}
-		if cfg == nil {
-			return errors.New("forced to config from environment, but no config found")
-		}
-	} else if forceFile {
-		var err error
-		slog.Debug("forced configuration from file", "path", forceFilePath)
-		cfg, err = configFromTOML(forceFilePath)
-		if err != nil {
-			return err
-		}
-	} else {
-		var err error
-		// try env first, then read from default config path
-		slog.Debug("try configuring from environment")
-		cfg, err = configFromEnv()
-		if err != nil {
-			return err
-		}
-		if cfg == nil {
-			slog.Debug("fallback to default config file", "path", defaultConfigPath)
-			// env doesn't contain config
-			cfg, err = configFromTOML(defaultConfigPath)
-			if err != nil {
-				return err
-			}
+	// select first, so that broken secret sources of the other accounts
+	// don't get in the way
+	err = selectAccounts(&lc.cfg, cCtx.StringSlice("account"), cCtx.StringSlice("account-tag"))
+	if err != nil {
+		return err
+	}
+
+	cfg, err := lc.finish()
+	if err != nil {
+		return err
+	}
+
+	err = loadAdoptions(cCtx, cfg)
+	if err != nil {
+		// adopted certs would be left behind by rotations, but otherwise
+		// they are merely shown as unmanaged
+		if slices.Contains(commandsRequiringAdoptions, cCtx.Command.Name) {
+			return fmt.Errorf("cannot load adopted certs: %w", err)
 		}
+		slog.Warn("cannot load adopted certs, treating them as unmanaged", "err", err)
+	}
+
+	err = setupAudit(cfg)
+	if err != nil {
+		return err
 	}
 
 	cCtx.Context = setConfig(cCtx.Context, cfg)
 	return nil
 }
+
+func loadConfigLayers(cCtx *cli.Context) (*layeredConfig, error) {
+	explicitPath := cCtx.Path("config")
+	if cCtx.Bool("env-config") && len(explicitPath) > 0 {
+		return nil, errors.New("cannot force configuration from both environment and file")
+	}
+
+	envOnly := isEnvOnlyConfig(cCtx)
+	slog.Debug("loading configuration", "explicitPath", explicitPath, "envOnly", envOnly)
+	return loadLayeredConfig(explicitPath, envOnly)
+}
+
+// isEnvOnlyConfig returns whether config files are to be ignored, as forced
+// with --env-config, or as implied by QCR_NUM_ACCOUNTS like in earlier
+// versions, unless a config file is explicitly given.
+func isEnvOnlyConfig(cCtx *cli.Context) bool {
+	if cCtx.Bool("env-config") {
+		return true
+	}
+	return len(cCtx.Path("config")) == 0 && len(os.Getenv(envNumAccounts)) > 0
+}
@@ -0,0 +1,338 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/template"
+	"time"
+)
+
+const notificationTimeout = 30 * time.Second
+
+// NotificationConfig 通知渠道配置
+type NotificationConfig struct {
+	// Type 渠道类型，可以是 webhook、smtp、wecom、dingtalk、feishu、slack 之一
+	Type string `toml:"type" yaml:"type" json:"type" jsonschema:"required"`
+	// Name 渠道名称，仅用于日志、调试信息等显示用途；可以留空
+	Name string `toml:"name" yaml:"name" json:"name"`
+	// On 何时发送轮换通知，可以是 always（默认）或 failure
+	On string `toml:"on" yaml:"on" json:"on"`
+
+	// URL webhook 地址，或企业微信、钉钉、飞书、Slack 机器人的地址
+	// 可以是 secret:// 形式的密钥引用
+	URL string `toml:"url" yaml:"url" json:"url" redact:"url"`
+	// Headers 发送 webhook 时附加的请求头
+	Headers map[string]string `toml:"headers" yaml:"headers" json:"headers" redact:"true"`
+	// Secret 钉钉、飞书机器人的签名密钥，可以是 secret:// 形式的密钥引用；可以留空
+	Secret string `toml:"secret" yaml:"secret" json:"secret" redact:"true"`
+
+	// SMTPAddr SMTP 服务器地址，如 "smtp.example.com:587"
+	SMTPAddr string `toml:"smtp_addr" yaml:"smtp_addr" json:"smtp_addr"`
+	// SMTPUsername SMTP 用户名；留空则不进行认证
+	SMTPUsername string `toml:"smtp_username" yaml:"smtp_username" json:"smtp_username"`
+	// SMTPPassword SMTP 密码，可以是 secret:// 形式的密钥引用
+	SMTPPassword string `toml:"smtp_password" yaml:"smtp_password" json:"smtp_password" redact:"true"`
+	// From 发件人地址
+	From string `toml:"from" yaml:"from" json:"from"`
+	// To 收件人地址
+	To []string `toml:"to" yaml:"to" json:"to"`
+
+	// Templates 各类通知的消息模板（Go text/template 语法），以通知类型为键，
+	// 如 "rotation"；留空则取默认模板
+	Templates map[string]*NotificationTemplate `toml:"templates" yaml:"templates" json:"templates"`
+}
+
+// NotificationTemplate 消息模板
+type NotificationTemplate struct {
+	// Subject 邮件标题模板，仅用于 smtp 渠道
+	Subject string `toml:"subject" yaml:"subject" json:"subject"`
+	// Body 消息正文模板
+	Body string `toml:"body" yaml:"body" json:"body"`
+}
+
+const (
+	notifyOnAlways  = "always"
+	notifyOnFailure = "failure"
+)
+
+// notificationKind names a kind of notifications, and keys the templates.
+type notificationKind string
+
+const notificationKindRotation notificationKind = "rotation"
+
+// notification is a message ready to be sent.
+type notification struct {
+	kind    notificationKind
+	success bool
+	subject string
+	text    string
+	// data is what the message is rendered from, sent as-is to generic
+	// webhooks
+	data any
+}
+
+// notifyFunc sends n with the channel nc.
+type notifyFunc func(ctx context.Context, nc *NotificationConfig, n *notification) error
+
+var notifiers = map[string]notifyFunc{}
+
+func registerNotifier(typ string, f notifyFunc) {
+	notifiers[typ] = f
+}
+
+func (nc *NotificationConfig) String() string {
+	if len(nc.Name) > 0 {
+		return nc.Name
+	}
+	return nc.Type
+}
+
+func (nc *NotificationConfig) postinit() error {
+	if _, ok := notifiers[nc.Type]; !ok {
+		return fmt.Errorf("unknown notification type '%s'", nc.Type)
+	}
+
+	switch nc.On {
+	case "":
+		nc.On = notifyOnAlways
+	case notifyOnAlways, notifyOnFailure:
+	default:
+		return fmt.Errorf("bad value '%s' for 'on', expected '%s' or '%s'", nc.On, notifyOnAlways, notifyOnFailure)
+	}
+
+	if nc.Type == "smtp" {
+		if len(nc.SMTPAddr) == 0 || len(nc.From) == 0 || len(nc.To) == 0 {
+			return errors.New("smtp_addr, from and to are required for smtp")
+		}
+	} else if len(nc.URL) == 0 {
+		return fmt.Errorf("url is required for %s", nc.Type)
+	}
+
+	for kind, t := range nc.Templates {
+		_, err := parseNotificationTemplate(kind, t.Subject, t.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseNotificationTemplate(kind string, subject string, body string) (*template.Template, error) {
+	t := template.New(kind)
+	_, err := t.New("subject").Parse(subject)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s subject template: %w", kind, err)
+	}
+	_, err = t.New("body").Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s body template: %w", kind, err)
+	}
+	return t, nil
+}
+
+// defaultNotificationTemplates are used for the kinds of notifications not
+// having a configured template.
+var defaultNotificationTemplates = map[notificationKind]*NotificationTemplate{}
+
+func registerDefaultNotificationTemplate(kind notificationKind, t *NotificationTemplate) {
+	defaultNotificationTemplates[kind] = t
+}
+
+// render fills the templates for nc with data.
+func (nc *NotificationConfig) render(
+	kind notificationKind,
+	success bool,
+	data any,
+) (*notification, error) {
+	subjectTmpl := defaultNotificationTemplates[kind].Subject
+	bodyTmpl := defaultNotificationTemplates[kind].Body
+	if custom, ok := nc.Templates[string(kind)]; ok {
+		if len(custom.Subject) > 0 {
+			subjectTmpl = custom.Subject
+		}
+		if len(custom.Body) > 0 {
+			bodyTmpl = custom.Body
+		}
+	}
+
+	t, err := parseNotificationTemplate(string(kind), subjectTmpl, bodyTmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	var subject, text bytes.Buffer
+	err = t.ExecuteTemplate(&subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+	err = t.ExecuteTemplate(&text, "body", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &notification{
+		kind:    kind,
+		success: success,
+		subject: subject.String(),
+		text:    text.String(),
+		data:    data,
+	}, nil
+}
+
+// sendNotifications renders and sends data with every configured channel
+// interested. Failures are logged and counted but don't stop the others.
+func sendNotifications(
+	ctx context.Context,
+	cfg *Config,
+	kind notificationKind,
+	success bool,
+	data any,
+) int {
+	numFailed := 0
+	for _, nc := range cfg.Notifications {
+		if kind == notificationKindRotation && success && nc.On == notifyOnFailure {
+			continue
+		}
+
+		err := sendNotification(ctx, nc, kind, success, data)
+		if err != nil {
+			slog.Error("failed to send notification", "channel", nc.String(), "kind", kind, "err", err)
+			numFailed++
+			continue
+		}
+		slog.Debug("sent notification", "channel", nc.String(), "kind", kind)
+	}
+	return numFailed
+}
+
+func sendNotification(
+	ctx context.Context,
+	nc *NotificationConfig,
+	kind notificationKind,
+	success bool,
+	data any,
+) error {
+	n, err := nc.render(kind, success, data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	defer cancel()
+
+	return notifiers[nc.Type](ctx, nc, n)
+}
+
+func hostnameOrUnknown() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "(unknown)"
+	}
+	return host
+}
+
+//////////////////////////////////////////////////////////////////////////////
+
+// rotationNotice is what rotation notifications are rendered from.
+type rotationNotice struct {
+	TracingKey string    `json:"tracingKey"`
+	Success    bool      `json:"success"`
+	Host       string    `json:"host"`
+	Time       time.Time `json:"time"`
+	// Expiry is the NotAfter of the new cert, zero if unknown
+	Expiry   time.Time                `json:"expiry,omitzero"`
+	Accounts []*rotationNoticeAccount `json:"accounts"`
+}
+
+type rotationNoticeAccount struct {
+	Name    string                  `json:"name"`
+	CertID  string                  `json:"certID,omitempty"`
+	Failed  bool                    `json:"failed"`
+	Error   string                  `json:"error,omitempty"`
+	Domains []*rotationNoticeDomain `json:"domains"`
+}
+
+type rotationNoticeDomain struct {
+	Name   string `json:"name"`
+	Failed bool   `json:"failed"`
+	Result string `json:"result"`
+}
+
+func init() {
+	registerDefaultNotificationTemplate(notificationKindRotation, &NotificationTemplate{
+		Subject: `[qcr] rotation of {{.TracingKey}} {{if .Success}}succeeded{{else}}FAILED{{end}}`,
+		Body: `Rotation of {{.TracingKey}} on {{.Host}} {{if .Success}}succeeded{{else}}FAILED{{end}}.
+{{- if not .Expiry.IsZero}}
+The new cert expires at {{.Expiry.Format "2006-01-02 15:04:05 MST"}}.
+{{- end}}
+{{range .Accounts}}
+Account {{.Name}}: {{if .Failed}}FAILED{{else}}ok{{end}}{{with .CertID}}, cert ID {{.}}{{end}}
+{{- with .Error}}
+  error: {{.}}
+{{- end}}
+{{- range .Domains}}
+  - {{.Name}}: {{.Result}}
+{{- end}}
+{{end}}`,
+	})
+}
+
+// newRotationNotice summarizes the reports of rotating the tracing key.
+// expiry may be zero if unknown.
+func newRotationNotice(key string, expiry time.Time, reports []*accountReport) *rotationNotice {
+	result := rotationNotice{
+		TracingKey: key,
+		Success:    true,
+		Host:       hostnameOrUnknown(),
+		Time:       time.Now(),
+		Expiry:     expiry,
+	}
+
+	for _, r := range reports {
+		acc := rotationNoticeAccount{
+			Name:   r.account,
+			CertID: r.certID,
+			Failed: r.failed(),
+		}
+		if r.err != nil {
+			acc.Error = r.err.Error()
+		}
+		for _, d := range r.domains {
+			acc.Domains = append(acc.Domains, &rotationNoticeDomain{
+				Name:   d.domain,
+				Failed: d.err != nil,
+				Result: d.String(),
+			})
+		}
+
+		if acc.Failed {
+			result.Success = false
+		}
+		result.Accounts = append(result.Accounts, &acc)
+	}
+
+	return &result
+}
+
+// notifyRotation sends rotation notifications, if any channel is configured.
+func notifyRotation(
+	ctx context.Context,
+	cfg *Config,
+	key string,
+	expiry time.Time,
+	reports []*accountReport,
+) {
+	if len(cfg.Notifications) == 0 {
+		return
+	}
+
+	notice := newRotationNotice(key, expiry, reports)
+	sendNotifications(ctx, cfg, notificationKindRotation, notice.Success, notice)
+}
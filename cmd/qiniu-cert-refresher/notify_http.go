@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func init() {
+	registerNotifier("webhook", notifyWebhook)
+	registerNotifier("wecom", notifyWeCom)
+	registerNotifier("dingtalk", notifyDingTalk)
+	registerNotifier("feishu", notifyFeishu)
+	registerNotifier("slack", notifySlack)
+}
+
+// notifyWebhook posts the notification as generic JSON, for consumption by
+// custom receivers.
+func notifyWebhook(ctx context.Context, nc *NotificationConfig, n *notification) error {
+	payload := map[string]any{
+		"kind":    n.kind,
+		"success": n.success,
+		"subject": n.subject,
+		"text":    n.text,
+		"data":    n.data,
+	}
+	_, err := postNotificationJSON(ctx, nc, nc.URL, payload)
+	return err
+}
+
+// notifyWeCom posts to a WeCom (企业微信) group bot.
+func notifyWeCom(ctx context.Context, nc *NotificationConfig, n *notification) error {
+	payload := map[string]any{
+		"msgtype": "text",
+		"text":    map[string]any{"content": n.text},
+	}
+	resp, err := postNotificationJSON(ctx, nc, nc.URL, payload)
+	if err != nil {
+		return err
+	}
+	return checkChatBotResp(resp, "errcode", "errmsg")
+}
+
+// notifyDingTalk posts to a DingTalk (钉钉) custom bot, signing the request if
+// a secret is configured.
+func notifyDingTalk(ctx context.Context, nc *NotificationConfig, n *notification) error {
+	target := nc.URL
+	if len(nc.Secret) > 0 {
+		secret, err := resolveSecret(ctx, nc.Secret)
+		if err != nil {
+			return err
+		}
+		target, err = resolveSecret(ctx, target)
+		if err != nil {
+			return err
+		}
+
+		ts := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "\n" + secret))
+		sign := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+		u, err := url.Parse(target)
+		if err != nil {
+			return fmt.Errorf("bad DingTalk URL: %w", err)
+		}
+		q := u.Query()
+		q.Set("timestamp", ts)
+		q.Set("sign", sign)
+		u.RawQuery = q.Encode()
+		target = u.String()
+	}
+
+	payload := map[string]any{
+		"msgtype": "text",
+		"text":    map[string]any{"content": n.text},
+	}
+	resp, err := postNotificationJSON(ctx, nc, target, payload)
+	if err != nil {
+		return err
+	}
+	return checkChatBotResp(resp, "errcode", "errmsg")
+}
+
+// notifyFeishu posts to a Feishu (飞书) custom bot, signing the request if a
+// secret is configured.
+func notifyFeishu(ctx context.Context, nc *NotificationConfig, n *notification) error {
+	payload := map[string]any{
+		"msg_type": "text",
+		"content":  map[string]any{"text": n.text},
+	}
+
+	if len(nc.Secret) > 0 {
+		secret, err := resolveSecret(ctx, nc.Secret)
+		if err != nil {
+			return err
+		}
+
+		// Feishu uses the string to sign as the key, and signs nothing
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(ts+"\n"+secret))
+		payload["timestamp"] = ts
+		payload["sign"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	resp, err := postNotificationJSON(ctx, nc, nc.URL, payload)
+	if err != nil {
+		return err
+	}
+	return checkChatBotResp(resp, "code", "msg")
+}
+
+// notifySlack posts to a Slack incoming webhook.
+func notifySlack(ctx context.Context, nc *NotificationConfig, n *notification) error {
+	_, err := postNotificationJSON(ctx, nc, nc.URL, map[string]any{"text": n.text})
+	return err
+}
+
+// postNotificationJSON posts payload to target, which may be a secret
+// reference, and returns the response body if the status is 2xx.
+func postNotificationJSON(
+	ctx context.Context,
+	nc *NotificationConfig,
+	target string,
+	payload any,
+) ([]byte, error) {
+	target, err := resolveSecret(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		// don't leak the URL, which often contains a token
+		return nil, fmt.Errorf("cannot make request for %s", nc)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range nc.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// same as above
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("cannot post to %s: %w", nc, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s returned HTTP %d", nc, resp.StatusCode)
+	}
+	return respBody, nil
+}
+
+// checkChatBotResp checks the application-level status chat bots return
+// with HTTP 200, in fields codeKey and msgKey.
+func checkChatBotResp(body []byte, codeKey string, msgKey string) error {
+	var resp map[string]any
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return fmt.Errorf("malformed bot response: %w", err)
+	}
+
+	code, _ := resp[codeKey].(float64)
+	if code != 0 {
+		return fmt.Errorf("bot returned error %v: %v", resp[codeKey], resp[msgKey])
+	}
+	return nil
+}
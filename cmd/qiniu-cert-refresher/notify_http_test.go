@@ -0,0 +1,230 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capturedRequest is a request received by a notificationStandIn.
+type capturedRequest struct {
+	header http.Header
+	query  url.Values
+	body   map[string]any
+}
+
+// notificationStandIn starts a local HTTP server answering every request
+// with respBody, and returns it along with the channel the received requests
+// go to.
+func notificationStandIn(t *testing.T, respBody string) (*httptest.Server, <-chan *capturedRequest) {
+	t.Helper()
+
+	reqs := make(chan *capturedRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("cannot read request body: %v", err)
+		}
+		c := capturedRequest{header: r.Header, query: r.URL.Query()}
+		err = json.Unmarshal(data, &c.body)
+		if err != nil {
+			t.Errorf("request body is not JSON: %v", err)
+		}
+		reqs <- &c
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, respBody)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+func testNotification() *notification {
+	return &notification{
+		kind:    notificationKindRotation,
+		success: false,
+		subject: "rotation FAILED",
+		text:    "Rotation of example.com FAILED.",
+		data:    map[string]any{"tracingKey": "example.com"},
+	}
+}
+
+func sendTestNotification(t *testing.T, nc *NotificationConfig) error {
+	t.Helper()
+	return notifiers[nc.Type](t.Context(), nc, testNotification())
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	srv, reqs := notificationStandIn(t, "")
+	nc := NotificationConfig{
+		Type:    "webhook",
+		URL:     srv.URL + "/hook",
+		Headers: map[string]string{"Authorization": "Bearer xyz"},
+	}
+
+	err := sendTestNotification(t, &nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-reqs
+	if got := r.header.Get("Authorization"); got != "Bearer xyz" {
+		t.Errorf("Authorization = %q, want the configured header", got)
+	}
+	if got := r.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if r.body["kind"] != "rotation" || r.body["success"] != false || r.body["subject"] != "rotation FAILED" {
+		t.Errorf("unexpected payload %v", r.body)
+	}
+	if data, _ := r.body["data"].(map[string]any); data["tracingKey"] != "example.com" {
+		t.Errorf("data not passed through: %v", r.body["data"])
+	}
+}
+
+func TestNotifyWebhookHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+	t.Cleanup(srv.Close)
+
+	err := sendTestNotification(t, &NotificationConfig{Type: "webhook", URL: srv.URL + "/?token=s3cr3t"})
+	if err == nil {
+		t.Fatal("expected an error for HTTP 403")
+	}
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("error leaks the URL: %v", err)
+	}
+}
+
+func TestNotifyWeCom(t *testing.T) {
+	srv, reqs := notificationStandIn(t, `{"errcode":0,"errmsg":"ok"}`)
+	err := sendTestNotification(t, &NotificationConfig{Type: "wecom", URL: srv.URL + "/send?key=k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-reqs
+	if r.query.Get("key") != "k" {
+		t.Errorf("query not kept: %v", r.query)
+	}
+	if r.body["msgtype"] != "text" {
+		t.Errorf("msgtype = %v", r.body["msgtype"])
+	}
+	if text, _ := r.body["text"].(map[string]any); text["content"] != testNotification().text {
+		t.Errorf("unexpected text %v", r.body["text"])
+	}
+}
+
+func TestNotifyWeComBotError(t *testing.T) {
+	srv, _ := notificationStandIn(t, `{"errcode":93000,"errmsg":"invalid webhook url"}`)
+	err := sendTestNotification(t, &NotificationConfig{Type: "wecom", URL: srv.URL})
+	if err == nil {
+		t.Fatal("expected the bot error to be reported")
+	}
+}
+
+func TestNotifyDingTalk(t *testing.T) {
+	srv, reqs := notificationStandIn(t, `{"errcode":0,"errmsg":"ok"}`)
+	const secret = "SECtest"
+	nc := NotificationConfig{
+		Type:   "dingtalk",
+		URL:    srv.URL + "/robot/send?access_token=tok",
+		Secret: secret,
+	}
+
+	before := time.Now().UnixMilli()
+	err := sendTestNotification(t, &nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-reqs
+	if r.query.Get("access_token") != "tok" {
+		t.Errorf("access_token not kept: %v", r.query)
+	}
+	ts := r.query.Get("timestamp")
+	if ms, err := strconv.ParseInt(ts, 10, 64); err != nil || ms < before || ms > time.Now().UnixMilli() {
+		t.Errorf("bad timestamp %q", ts)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "\n" + secret))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); r.query.Get("sign") != want {
+		t.Errorf("sign = %q, want %q", r.query.Get("sign"), want)
+	}
+	text, _ := r.body["text"].(map[string]any)
+	if r.body["msgtype"] != "text" || text["content"] != testNotification().text {
+		t.Errorf("unexpected payload %v", r.body)
+	}
+}
+
+func TestNotifyDingTalkUnsigned(t *testing.T) {
+	srv, reqs := notificationStandIn(t, `{"errcode":0,"errmsg":"ok"}`)
+	err := sendTestNotification(t, &NotificationConfig{Type: "dingtalk", URL: srv.URL + "/?access_token=tok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-reqs
+	if r.query.Has("sign") || r.query.Has("timestamp") {
+		t.Errorf("unexpected signature without a secret: %v", r.query)
+	}
+}
+
+func TestNotifyFeishu(t *testing.T) {
+	srv, reqs := notificationStandIn(t, `{"code":0,"msg":"success"}`)
+	const secret = "feishu-secret"
+	err := sendTestNotification(t, &NotificationConfig{Type: "feishu", URL: srv.URL + "/hook/x", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-reqs
+	if r.body["msg_type"] != "text" {
+		t.Errorf("msg_type = %v", r.body["msg_type"])
+	}
+	if content, _ := r.body["content"].(map[string]any); content["text"] != testNotification().text {
+		t.Errorf("unexpected content %v", r.body["content"])
+	}
+	ts, _ := r.body["timestamp"].(string)
+	if _, err := strconv.ParseInt(ts, 10, 64); err != nil {
+		t.Errorf("bad timestamp %q", ts)
+	}
+	// Feishu signs nothing with the string to sign as the key
+	mac := hmac.New(sha256.New, []byte(ts+"\n"+secret))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); r.body["sign"] != want {
+		t.Errorf("sign = %v, want %q", r.body["sign"], want)
+	}
+}
+
+func TestNotifyFeishuBotError(t *testing.T) {
+	srv, _ := notificationStandIn(t, `{"code":19021,"msg":"sign match fail"}`)
+	err := sendTestNotification(t, &NotificationConfig{Type: "feishu", URL: srv.URL, Secret: "x"})
+	if err == nil {
+		t.Fatal("expected the bot error to be reported")
+	}
+}
+
+func TestNotifySlack(t *testing.T) {
+	srv, reqs := notificationStandIn(t, "ok")
+	err := sendTestNotification(t, &NotificationConfig{Type: "slack", URL: srv.URL + "/services/T/B/X"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-reqs
+	if len(r.body) != 1 || r.body["text"] != testNotification().text {
+		t.Errorf("unexpected payload %v", r.body)
+	}
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerNotifier("smtp", notifySMTP)
+}
+
+// notifySMTP sends the notification as a plain text email. STARTTLS is used
+// if the server supports it.
+func notifySMTP(ctx context.Context, nc *NotificationConfig, n *notification) error {
+	var auth smtp.Auth
+	if len(nc.SMTPUsername) > 0 {
+		password, err := resolveSecret(ctx, nc.SMTPPassword)
+		if err != nil {
+			return err
+		}
+
+		host, _, err := net.SplitHostPort(nc.SMTPAddr)
+		if err != nil {
+			return fmt.Errorf("bad smtp_addr: %w", err)
+		}
+		auth = smtp.PlainAuth("", nc.SMTPUsername, password, host)
+	}
+
+	msg := composeEmail(nc.From, nc.To, n.subject, n.text)
+
+	// net/smtp knows nothing about contexts, so at least respect the deadline
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- smtp.SendMail(nc.SMTPAddr, auth, nc.From, nc.To, msg)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return errors.New("timed out sending email")
+	}
+}
+
+func composeEmail(from string, to []string, subject string, body string) []byte {
+	var sb strings.Builder
+	sb.WriteString("From: ")
+	sb.WriteString(from)
+	sb.WriteString("\r\nTo: ")
+	sb.WriteString(strings.Join(to, ", "))
+	sb.WriteString("\r\nSubject: ")
+	sb.WriteString(mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	sb.WriteString("\r\nDate: ")
+	sb.WriteString(time.Now().Format(time.RFC1123Z))
+	sb.WriteString("\r\nMIME-Version: 1.0")
+	sb.WriteString("\r\nContent-Type: text/plain; charset=utf-8")
+	sb.WriteString("\r\nContent-Transfer-Encoding: 8bit")
+	sb.WriteString("\r\n\r\n")
+	// bare LFs are not allowed in SMTP
+	sb.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(sb.String())
+}
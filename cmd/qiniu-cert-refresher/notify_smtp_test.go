@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpSession is what a fakeSMTPServer has received in one session.
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer accepts one session on a local listener, speaking just
+// enough SMTP for net/smtp, with AUTH PLAIN but without STARTTLS.
+func fakeSMTPServer(t *testing.T) (string, <-chan *smtpSession) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	sessions := make(chan *smtpSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		var s smtpSession
+		reply := func(line string) {
+			_ = tp.PrintfLine("%s", line)
+		}
+
+		reply("220 fake ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				reply("250-fake")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				_, resp, _ := strings.Cut(arg, " ")
+				decoded, _ := base64.StdEncoding.DecodeString(resp)
+				s.auth = string(decoded)
+				reply("235 ok")
+			case "MAIL":
+				s.from = arg
+				reply("250 ok")
+			case "RCPT":
+				s.to = append(s.to, arg)
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				lines, err := tp.ReadDotLines()
+				if err != nil {
+					return
+				}
+				s.data = strings.Join(lines, "\n")
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				sessions <- &s
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+
+	return l.Addr().String(), sessions
+}
+
+func TestNotifySMTP(t *testing.T) {
+	addr, sessions := fakeSMTPServer(t)
+	nc := NotificationConfig{
+		Type:         "smtp",
+		SMTPAddr:     addr,
+		SMTPUsername: "qcr",
+		SMTPPassword: "hunter2",
+		From:         "qcr@example.com",
+		To:           []string{"ops@example.com", "sec@example.com"},
+	}
+
+	err := sendTestNotification(t, &nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := <-sessions
+	if s.auth != "\x00qcr\x00hunter2" {
+		t.Errorf("auth = %q", s.auth)
+	}
+	if s.from != "FROM:<qcr@example.com>" {
+		t.Errorf("from = %q", s.from)
+	}
+	if len(s.to) != 2 || s.to[0] != "TO:<ops@example.com>" || s.to[1] != "TO:<sec@example.com>" {
+		t.Errorf("to = %q", s.to)
+	}
+
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(s.data + "\n"))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("malformed message headers: %v", err)
+	}
+	if got := msg.Get("Subject"); got != "rotation FAILED" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := msg.Get("To"); got != "ops@example.com, sec@example.com" {
+		t.Errorf("To = %q", got)
+	}
+	if got := msg.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if !strings.HasSuffix(s.data, testNotification().text) {
+		t.Errorf("body missing from %q", s.data)
+	}
+}
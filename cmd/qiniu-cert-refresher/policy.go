@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+// HTTPSPolicy 对一组域名期望的 HTTPS 配置
+// 由 reconcile 施行；upload 与 refresh 仅更换证书，除 KeyType 外不涉及其余配置
+type HTTPSPolicy struct {
+	// Domains 适用的域名 glob 模式，如 "*.example.com"
+	Domains []string `toml:"domains" yaml:"domains" json:"domains"`
+	// DomainRegexes 适用的域名正则表达式
+	DomainRegexes []string `toml:"domain_regexes" yaml:"domain_regexes" json:"domain_regexes"`
+	// ForceHTTPS 期望的强制 HTTPS 开关，留空表示不管理此项
+	ForceHTTPS *bool `toml:"force_https" yaml:"force_https" json:"force_https"`
+	// HTTP2 期望的 HTTP/2 开关，留空表示不管理此项
+	HTTP2 *bool `toml:"http2" yaml:"http2" json:"http2"`
+	// KeyType 同一追踪键下同时存在 RSA 与 ECDSA 证书时，这些域名应绑定的证书密钥类型，
+	// 可以是 rsa 或 ecdsa；留空则取账号的配置
+	KeyType string `toml:"key_type" yaml:"key_type" json:"key_type"`
+
+	matcher *domainMatcher
+}
+
+// domainMatcher matches domain names against globs and regexes.
+type domainMatcher struct {
+	globs   []string
+	regexes []*regexp.Regexp
+}
+
+func newDomainMatcher(globs []string, regexes []string) (*domainMatcher, error) {
+	if len(globs) == 0 && len(regexes) == 0 {
+		return nil, errors.New("no domain selector given")
+	}
+
+	for _, g := range globs {
+		_, err := path.Match(g, "")
+		if err != nil {
+			return nil, fmt.Errorf("bad domain glob '%s': %w", g, err)
+		}
+	}
+
+	result := domainMatcher{globs: globs}
+	for _, r := range regexes {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("bad domain regex '%s': %w", r, err)
+		}
+		result.regexes = append(result.regexes, re)
+	}
+
+	return &result, nil
+}
+
+func (m *domainMatcher) matches(domain string) bool {
+	for _, g := range m.globs {
+		if ok, _ := path.Match(g, domain); ok {
+			return true
+		}
+	}
+	for _, re := range m.regexes {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *HTTPSPolicy) postinit() error {
+	matcher, err := newDomainMatcher(p.Domains, p.DomainRegexes)
+	if err != nil {
+		return err
+	}
+	p.matcher = matcher
+
+	if len(p.KeyType) > 0 {
+		kt, err := parseCertKeyType(p.KeyType)
+		if err != nil {
+			return err
+		}
+		p.KeyType = string(kt)
+	}
+
+	return nil
+}
+
+func (p *HTTPSPolicy) matches(domain string) bool {
+	return p.matcher.matches(domain)
+}
+
+// findHTTPSPolicy returns the first policy of the account applicable to the
+// domain, or nil if there is none.
+func findHTTPSPolicy(acc *AccountConfig, domain string) *HTTPSPolicy {
+	for _, p := range acc.HTTPSPolicies {
+		if p.matches(domain) {
+			return p
+		}
+	}
+	return nil
+}
+
+// httpsDrift describes one HTTPS config flag that differs from the policy.
+type httpsDrift struct {
+	Field   string
+	Current bool
+	Desired bool
+}
+
+func (d httpsDrift) String() string {
+	return fmt.Sprintf("%s: %t -> %t", d.Field, d.Current, d.Desired)
+}
+
+// apply returns the HTTPS config the policy wants, along with the differences
+// from the current one. The current config is left untouched.
+func (p *HTTPSPolicy) apply(cur *qcdn.HTTPSConfig) (*qcdn.HTTPSConfig, []httpsDrift) {
+	desired := *cur
+
+	var drifts []httpsDrift
+	if p.ForceHTTPS != nil && *p.ForceHTTPS != cur.ForceHTTPS {
+		desired.ForceHTTPS = *p.ForceHTTPS
+		drifts = append(drifts, httpsDrift{"forceHttps", cur.ForceHTTPS, *p.ForceHTTPS})
+	}
+	if p.HTTP2 != nil && *p.HTTP2 != cur.HTTP2Enabled {
+		desired.HTTP2Enabled = *p.HTTP2
+		drifts = append(drifts, httpsDrift{"http2Enable", cur.HTTP2Enabled, *p.HTTP2})
+	}
+
+	return &desired, drifts
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// configSchemaKey is the root key in config files for pointing editors to the
+// schema, which is otherwise ignored.
+const configSchemaKey = "$schema"
+
+// configJSONSchema generates the JSON Schema of the config file from the
+// config structs, so the two never go out of sync. It applies to YAML files
+// as well, as the field names are the same in every supported format.
+func configJSONSchema() map[string]any {
+	s := schemaForType(reflect.TypeFor[Config]())
+	s[configSchemaKey] = "https://json-schema.org/draft/2020-12/schema"
+	s["properties"].(map[string]any)[configSchemaKey] = map[string]any{"type": "string"}
+	s["title"] = "qiniu-cert-refresher configuration"
+	return s
+}
+
+// configFieldName returns the key of the struct field in config files, and
+// whether the field appears in config files at all.
+func configFieldName(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" || name == "" {
+		return "", false
+	}
+	return name, true
+}
+
+func schemaForType(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaForType(t.Elem())
+
+	case reflect.Struct:
+		props := make(map[string]any)
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, ok := configFieldName(f)
+			if !ok {
+				continue
+			}
+
+			props[name] = schemaForType(f.Type)
+			if f.Tag.Get("jsonschema") == "required" {
+				required = append(required, name)
+			}
+		}
+
+		s := map[string]any{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+
+	case reflect.Slice, reflect.Array:
+		return map[string]any{
+			"type":  "array",
+			"items": schemaForType(t.Elem()),
+		}
+
+	case reflect.Map:
+		return map[string]any{
+			"type":                 "object",
+			"additionalProperties": schemaForType(t.Elem()),
+		}
+
+	case reflect.String:
+		return map[string]any{"type": "string"}
+
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+
+	default:
+		return map[string]any{}
+	}
+}
+
+// unknownConfigKeys walks the generically decoded config v along the config
+// struct type t, returning the paths of the object keys that don't map to any
+// field.
+func unknownConfigKeys(v any, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var result []string
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if name, ok := configFieldName(f); ok {
+				fields[name] = f.Type
+			}
+		}
+
+		for k, val := range obj {
+			if path == "" && k == configSchemaKey {
+				continue
+			}
+
+			p := joinConfigPath(path, k)
+			ft, ok := fields[k]
+			if !ok {
+				result = append(result, p)
+				continue
+			}
+			result = append(result, unknownConfigKeys(val, ft, p)...)
+		}
+
+	case reflect.Slice, reflect.Array:
+		arr, ok := v.([]any)
+		if !ok {
+			return nil
+		}
+		for i, val := range arr {
+			result = append(result, unknownConfigKeys(val, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+
+	case reflect.Map:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		for k, val := range obj {
+			result = append(result, unknownConfigKeys(val, t.Elem(), joinConfigPath(path, k))...)
+		}
+	}
+
+	return result
+}
+
+func joinConfigPath(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
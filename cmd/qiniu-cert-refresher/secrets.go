@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const secretRefScheme = "secret://"
+
+const secretResolutionTimeout = 30 * time.Second
+
+// secretBackend resolves the part of a secret:// reference after the backend
+// name. Errors must not contain the secret itself.
+type secretBackend func(ctx context.Context, ref string) (string, error)
+
+var secretBackends = map[string]secretBackend{}
+
+func registerSecretBackend(name string, b secretBackend) {
+	secretBackends[name] = b
+}
+
+func init() {
+	registerSecretBackend("file", resolveSecretFromFile)
+	registerSecretBackend("env", resolveSecretFromEnv)
+	registerSecretBackend("exec", resolveSecretFromCommand)
+	registerSecretBackend("vault", resolveSecretFromVault)
+}
+
+func isSecretRef(s string) bool {
+	return strings.HasPrefix(s, secretRefScheme)
+}
+
+// resolveSecret returns s unchanged unless it is a secret reference of the
+// form secret://<backend>/<ref>, in which case the referenced secret is
+// returned.
+func resolveSecret(ctx context.Context, s string) (string, error) {
+	if !isSecretRef(s) {
+		return s, nil
+	}
+
+	backendName, ref, _ := strings.Cut(strings.TrimPrefix(s, secretRefScheme), "/")
+	backend, ok := secretBackends[backendName]
+	if !ok {
+		return "", fmt.Errorf("unknown secret backend '%s'", backendName)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, secretResolutionTimeout)
+	defer cancel()
+
+	return backend(ctx, ref)
+}
+
+// resolveSecretFromFile reads secret://file/<absolute path without the
+// leading slash>.
+func resolveSecretFromFile(_ context.Context, ref string) (string, error) {
+	return readSecretFile("/" + ref)
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// resolveSecretFromEnv reads secret://env/<variable name>.
+func resolveSecretFromEnv(_ context.Context, ref string) (string, error) {
+	val, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return val, nil
+}
+
+// resolveSecretFromCommand runs secret://exec/<command line> with the shell
+// and takes its standard output.
+func resolveSecretFromCommand(ctx context.Context, ref string) (string, error) {
+	return runSecretCommand(ctx, ref)
+}
+
+func runSecretCommand(ctx context.Context, cmdline string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", cmdline)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", cmdline)
+	}
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		// don't include the output, in case the command printed the secret
+		// before failing
+		return "", fmt.Errorf("secret command failed: %w", err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// resolveSecretFromVault reads secret://vault/<API path>#<field> from a
+// HashiCorp Vault compatible server, e.g. secret://vault/secret/data/qiniu#sk
+// for KV v2 mounted at secret/. The server address and token are taken from
+// VAULT_ADDR and VAULT_TOKEN (or ~/.vault-token) respectively.
+func resolveSecretFromVault(ctx context.Context, ref string) (string, error) {
+	apiPath, field, ok := strings.Cut(ref, "#")
+	if !ok || len(field) == 0 {
+		return "", errors.New("vault secret reference lacks a #field")
+	}
+
+	addr := os.Getenv("VAULT_ADDR")
+	if len(addr) == 0 {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+
+	token, err := vaultToken()
+	if err != nil {
+		return "", err
+	}
+
+	url := strings.TrimRight(addr, "/") + "/v1/" + strings.TrimLeft(apiPath, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned HTTP %d for %s", resp.StatusCode, apiPath)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var payload struct {
+		Data map[string]any `json:"data"`
+	}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		return "", fmt.Errorf("malformed vault response for %s", apiPath)
+	}
+
+	// KV v2 nests the actual key-value pairs one level deeper
+	data := payload.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+
+	val, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("no string field '%s' in vault secret %s", field, apiPath)
+	}
+	return val, nil
+}
+
+func vaultToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); len(token) > 0 {
+		return token, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.New("VAULT_TOKEN is not set")
+	}
+
+	token, err := readSecretFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return "", errors.New("VAULT_TOKEN is not set and ~/.vault-token is unreadable")
+	}
+	return token, nil
+}
@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testVaultToken = "s.test-token"
+
+// vaultStandIn starts a local HTTP server serving a KV v2 secret at
+// secret/data/qiniu and a KV v1 secret at kv/qiniu to requests bearing
+// testVaultToken.
+func vaultStandIn(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/secret/data/qiniu":
+			_, _ = io.WriteString(w, `{"data":{"data":{"sk":"kv2-secret","n":1},"metadata":{"version":3}}}`)
+		case "/v1/kv/qiniu":
+			_, _ = io.WriteString(w, `{"data":{"sk":"kv1-secret"}}`)
+		case "/v1/broken":
+			_, _ = io.WriteString(w, `{"data":`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "sk")
+	err := os.WriteFile(secretFile, []byte("file-secret\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileRef := "secret://file/" + strings.TrimPrefix(filepath.ToSlash(secretFile), "/")
+
+	t.Setenv("QCR_TEST_SECRET", "env-secret")
+	t.Setenv("VAULT_ADDR", vaultStandIn(t).URL+"/")
+	t.Setenv("VAULT_TOKEN", testVaultToken)
+
+	testcases := []struct {
+		name    string
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{name: "plain value", ref: "not-a-ref", want: "not-a-ref"},
+		{name: "unknown backend", ref: "secret://kms/foo", wantErr: "unknown secret backend 'kms'"},
+		{name: "file", ref: fileRef, want: "file-secret"},
+		{name: "missing file", ref: fileRef + ".missing", wantErr: "no such file"},
+		{name: "env", ref: "secret://env/QCR_TEST_SECRET", want: "env-secret"},
+		{name: "unset env", ref: "secret://env/QCR_TEST_UNSET", wantErr: "QCR_TEST_UNSET is not set"},
+		{name: "exec", ref: "secret://exec/echo exec-secret", want: "exec-secret"},
+		{name: "failing exec", ref: "secret://exec/echo leaked && exit 3", wantErr: "secret command failed"},
+		{name: "vault kv v2", ref: "secret://vault/secret/data/qiniu#sk", want: "kv2-secret"},
+		{name: "vault kv v1", ref: "secret://vault/kv/qiniu#sk", want: "kv1-secret"},
+		{name: "vault without field", ref: "secret://vault/kv/qiniu", wantErr: "lacks a #field"},
+		{name: "vault empty field", ref: "secret://vault/kv/qiniu#", wantErr: "lacks a #field"},
+		{name: "vault missing field", ref: "secret://vault/kv/qiniu#ak", wantErr: "no string field 'ak'"},
+		{name: "vault non-string field", ref: "secret://vault/secret/data/qiniu#n", wantErr: "no string field 'n'"},
+		{name: "vault missing secret", ref: "secret://vault/kv/nope#sk", wantErr: "vault returned HTTP 404"},
+		{name: "vault malformed response", ref: "secret://vault/broken#sk", wantErr: "malformed vault response"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveSecret(t.Context(), tc.ref)
+			if len(tc.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tc.wantErr)
+				}
+				if strings.Contains(err.Error(), "leaked") {
+					t.Errorf("err %q contains the command output", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("resolved to %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveSecretFromVaultCredentials(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("VAULT_TOKEN", "")
+	const ref = "secret://vault/kv/qiniu#sk"
+
+	t.Setenv("VAULT_ADDR", "")
+	_, err := resolveSecret(t.Context(), ref)
+	if err == nil || !strings.Contains(err.Error(), "VAULT_ADDR is not set") {
+		t.Errorf("err = %v without VAULT_ADDR", err)
+	}
+
+	t.Setenv("VAULT_ADDR", vaultStandIn(t).URL)
+	_, err = resolveSecret(t.Context(), ref)
+	if err == nil || !strings.Contains(err.Error(), "~/.vault-token is unreadable") {
+		t.Errorf("err = %v without any token", err)
+	}
+
+	// the token written by `vault login`
+	err = os.WriteFile(filepath.Join(home, ".vault-token"), []byte(testVaultToken+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := resolveSecret(t.Context(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "kv1-secret" {
+		t.Errorf("resolved to %q, want %q", got, "kv1-secret")
+	}
+
+	t.Setenv("VAULT_TOKEN", "s.wrong-token")
+	_, err = resolveSecret(t.Context(), ref)
+	if err == nil || !strings.Contains(err.Error(), "vault returned HTTP 403") {
+		t.Errorf("err = %v with a wrong token", err)
+	}
+}
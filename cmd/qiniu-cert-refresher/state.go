@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+// defaultStateDir returns where local state such as rotation journals is
+// kept, honoring XDG_STATE_HOME.
+func defaultStateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); len(dir) > 0 {
+		return filepath.Join(dir, "qcr"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		// don't silently fall back to the working directory
+		return "", fmt.Errorf("cannot determine the state dir, please specify one with --state-dir: %w", err)
+	}
+	return filepath.Join(home, ".local", "state", "qcr"), nil
+}
+
+// stateDir returns the state dir given on the command line, or the default.
+func stateDir(cCtx *cli.Context) (string, error) {
+	if dir := cCtx.Path("state-dir"); len(dir) > 0 {
+		return dir, nil
+	}
+	return defaultStateDir()
+}
+
+// stateSubdir returns the named subdirectory of the state dir, creating it
+// if necessary.
+func stateSubdir(cCtx *cli.Context, name string) (string, error) {
+	dir, err := stateDir(cCtx)
+	if err != nil {
+		return "", err
+	}
+	result := filepath.Join(dir, name)
+	err = os.MkdirAll(result, 0o700)
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// writeFileAtomic writes then renames, so that a crash leaves either the old
+// or the new content at path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
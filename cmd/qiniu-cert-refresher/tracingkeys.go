@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xen0n/qiniu-cert-refresher/api/qcdn"
+)
+
+// TracingKeyConfig 追踪键与其证书应绑定的域名
+// 声明后，upload 与 refresh 将恰好绑定这些域名，而不再沿用旧证书所绑定的域名
+type TracingKeyConfig struct {
+	// Key 追踪键
+	Key string `toml:"key" yaml:"key" json:"key" jsonschema:"required"`
+	// Domains 应绑定该追踪键证书的域名，可以是完整域名或 glob 模式，如 "*.example.com"
+	// 完整域名若不存在于该账号下，将被视为配置偏差
+	Domains []string `toml:"domains" yaml:"domains" json:"domains"`
+	// DomainRegexes 应绑定该追踪键证书的域名正则表达式
+	DomainRegexes []string `toml:"domain_regexes" yaml:"domain_regexes" json:"domain_regexes"`
+
+	matcher *domainMatcher
+}
+
+func (t *TracingKeyConfig) postinit() error {
+	if strings.TrimSpace(t.Key) == "" {
+		return errors.New("tracing key must not be blank")
+	}
+
+	matcher, err := newDomainMatcher(t.Domains, t.DomainRegexes)
+	if err != nil {
+		return fmt.Errorf("tracing key '%s': %w", t.Key, err)
+	}
+	t.matcher = matcher
+	return nil
+}
+
+// findTracingKeyConfig returns the declaration of the tracing key, or nil if
+// the key is not declared for the account.
+func (x *AccountConfig) findTracingKeyConfig(key string) *TracingKeyConfig {
+	for _, t := range x.TracingKeys {
+		if t.Key == key {
+			return t
+		}
+	}
+	return nil
+}
+
+func isDomainGlob(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+// expectedDomains returns the domains among all that should be bound to the
+// tracing key, along with the explicitly declared domains missing from all.
+func (t *TracingKeyConfig) expectedDomains(all []*qcdn.Domain) ([]*qcdn.Domain, []string) {
+	var expected []*qcdn.Domain
+	found := make(map[string]struct{})
+	for _, d := range all {
+		if t.matcher.matches(d.Name) {
+			expected = append(expected, d)
+			found[d.Name] = struct{}{}
+		}
+	}
+
+	var missing []string
+	for _, name := range t.Domains {
+		if isDomainGlob(name) {
+			continue
+		}
+		if _, ok := found[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+
+	return expected, missing
+}
+
+// queryCurrentCertID returns the ID of the cert the domain is using, or the
+// empty string if the domain is not serving HTTPS. The domain is always
+// queried, as the listing API doesn't return the HTTPS config.
+func queryCurrentCertID(acc *AccountConfig, domain string) (string, error) {
+	d, err := qcdn.GetDomain(acc.qiniuCreds, domain)
+	if err != nil {
+		return "", err
+	}
+	if d.Protocol != "https" || d.HTTPS == nil {
+		return "", nil
+	}
+	return d.HTTPS.CertID, nil
+}
+
+// domainBindings maps the names of the domains bound to any of the certs to
+// the IDs of their certs, given the domains of each cert as listed by
+// qcdn.ListAllDomainsByCertID.
+func domainBindings(domainsByCertID map[string][]*qcdn.Domain) map[string]string {
+	result := make(map[string]string)
+	for certID, domains := range domainsByCertID {
+		for _, d := range domains {
+			result[d.Name] = certID
+		}
+	}
+	return result
+}
+
+var errHTTPSNotEnabled = errors.New("HTTPS is not enabled for the domain")
+
+//////////////////////////////////////////////////////////////////////////////
+
+type domainDriftKind int
+
+const (
+	// the domain is declared but bound to another cert, or not serving HTTPS
+	driftElsewhere domainDriftKind = iota
+	// the domain is explicitly declared but doesn't exist
+	driftMissing
+	// the domain is bound to a cert of the tracing key but not declared
+	driftUndeclared
+)
+
+// domainDrift is a difference between the declared domains of a tracing key
+// and the actual bindings.
+type domainDrift struct {
+	Domain string
+	Kind   domainDriftKind
+	// CertID is the cert currently bound, if any
+	CertID string
+}
+
+func (d domainDrift) String() string {
+	switch d.Kind {
+	case driftElsewhere:
+		if len(d.CertID) == 0 {
+			return "declared, but HTTPS is not enabled"
+		}
+		return fmt.Sprintf("declared, but bound to cert %s", d.CertID)
+	case driftMissing:
+		return "declared, but not found"
+	case driftUndeclared:
+		return fmt.Sprintf("bound to cert %s, but not declared", d.CertID)
+	default:
+		return "(unknown drift)"
+	}
+}
+
+// findTracingKeyDrifts compares the declaration of the tracing key with the
+// actual bindings of all domains of the account, as returned by
+// domainBindings, keyCertIDs being the IDs of the certs of the key.
+func findTracingKeyDrifts(
+	t *TracingKeyConfig,
+	all []*qcdn.Domain,
+	bindings map[string]string,
+	keyCertIDs map[string]struct{},
+) []domainDrift {
+	expected, missing := t.expectedDomains(all)
+
+	var result []domainDrift
+	isExpected := make(map[string]struct{})
+	for _, d := range expected {
+		isExpected[d.Name] = struct{}{}
+		certID := bindings[d.Name]
+		if _, ok := keyCertIDs[certID]; !ok {
+			result = append(result, domainDrift{Domain: d.Name, Kind: driftElsewhere, CertID: certID})
+		}
+	}
+	for _, name := range missing {
+		result = append(result, domainDrift{Domain: name, Kind: driftMissing})
+	}
+	for _, d := range all {
+		if _, ok := isExpected[d.Name]; ok {
+			continue
+		}
+		certID := bindings[d.Name]
+		if _, ok := keyCertIDs[certID]; ok {
+			result = append(result, domainDrift{Domain: d.Name, Kind: driftUndeclared, CertID: certID})
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+)
+
+// accountReport records the outcome of rotating a cert for one account.
+type accountReport struct {
+	account string
+	// certID is the ID of the cert the domains are switched to, if known
+	certID string
+	// err is the failure preventing the account from being processed as a
+	// whole, such as a failed upload
+	err error
+
+	mu      sync.Mutex
+	domains []domainOutcome
+}
+
+type domainOutcome struct {
+	domain string
+	err    error
+	// skipReason is non-empty if the domain is deliberately left alone, which
+	// is not a failure
+	skipReason string
+}
+
+func newAccountReport(acc *AccountConfig) *accountReport {
+	return &accountReport{account: acc.DisplayName}
+}
+
+// recordDomain is safe for concurrent use.
+func (r *accountReport) recordDomain(domain string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.domains = append(r.domains, domainOutcome{domain: domain, err: err})
+}
+
+// recordSkippedDomain is safe for concurrent use.
+func (r *accountReport) recordSkippedDomain(domain string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.domains = append(r.domains, domainOutcome{domain: domain, skipReason: reason})
+}
+
+func (r *accountReport) failed() bool {
+	if r.err != nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.domains {
+		if d.err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *domainOutcome) String() string {
+	if len(o.skipReason) > 0 {
+		return "skipped: " + o.skipReason
+	}
+	return outcomeString(o.err)
+}
+
+func outcomeString(err error) string {
+	if err != nil {
+		return "FAILED: " + err.Error()
+	}
+	return "ok"
+}
+
+// printUploadSummary prints one line per account and domain, returning the
+// number of failed accounts.
+func printUploadSummary(w io.Writer, reports []*accountReport) int {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tDOMAIN\tCERT ID\tRESULT")
+
+	numFailed := 0
+	for _, r := range reports {
+		if r.failed() {
+			numFailed++
+		}
+
+		if r.err != nil || len(r.domains) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t%s\t%s\n", r.account, r.certID, outcomeString(r.err))
+		}
+		for _, d := range r.domains {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.account, d.domain, r.certID, &d)
+		}
+	}
+	tw.Flush()
+
+	return numFailed
+}
@@ -8,11 +8,15 @@ require (
 	github.com/samber/lo v1.53.0
 	github.com/urfave/cli/v2 v2.27.7
 	golang.org/x/sync v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.7 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20240521201337-686a1a2994c1 // indirect
+	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
 )